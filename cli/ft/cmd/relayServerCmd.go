@@ -16,14 +16,19 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
+	"github.com/gtarcea/ft/hero"
 	"github.com/gtarcea/ft/internal/relay"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // relayServerCmd represents the relayServer command
@@ -39,6 +44,13 @@ to quickly create a Cobra application.`,
 	Run: runRelayServerCmd,
 }
 
+var (
+	relayCertFile     string
+	relayKeyFile      string
+	relayClientCAFile string
+	relaySelfSigned   bool
+)
+
 func init() {
 	rootCmd.AddCommand(relayServerCmd)
 
@@ -51,22 +63,128 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// relayServerCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	relayServerCmd.Flags().StringVar(&relayCertFile, "cert", "", "TLS certificate file")
+	relayServerCmd.Flags().StringVar(&relayKeyFile, "key", "", "TLS key file")
+	relayServerCmd.Flags().StringVar(&relayClientCAFile, "client-ca", "", "CA file for verifying client certificates, turns on mutual TLS")
+	relayServerCmd.Flags().BoolVar(&relaySelfSigned, "self-signed", false,
+		"Use a self-signed certificate. It is saved to --cert and --key when they are given and don't exist yet")
+	relayServerCmd.Flags().String("relay-password", relay.Password, "Password clients authenticate with (config: relay_password)")
+	relayServerCmd.Flags().String("app-id", relay.AppId, "App ID clients authenticate with (config: app_id)")
+	relayServerCmd.Flags().Bool("require-slot-secret", false,
+		"Only pair clients that prove they share a secret for their relay key (config: require_slot_secret)")
+	relayServerCmd.Flags().String("admin-token", "", "Turns on the admin HTTP API, protected by this token (config: admin_token)")
+	relayServerCmd.Flags().String("admin-address", relay.DefaultAdminAddress, "Address for the admin HTTP API (config: admin_address)")
 }
 
 func runRelayServerCmd(cmd *cobra.Command, args []string) {
 	fmt.Println("Starting RelayServer...")
-	server := relay.NewServer(":10001", relay.Password)
+	bindFlagsToConfig(cmd, "relay-password", "app-id", "require-slot-secret", "admin-token", "admin-address")
+	server := relay.NewServer(":10001", viper.GetString("relay_password"))
+	server.AppID = viper.GetString("app_id")
+	server.RequireSlotSecret = viper.GetBool("require_slot_secret")
+	server.AdminToken = viper.GetString("admin_token")
+	server.AdminAddress = viper.GetString("admin_address")
+	tlsConfig, err := relayTLSConfig()
+	if err != nil {
+		fmt.Println("Unable to set up TLS:", err)
+		return
+	}
+	server.TLSConfig = tlsConfig
+
 	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
 	go func() {
-		if err := server.Start(ctx); err != nil {
-			fmt.Println("Unable to start RelayServer")
+		defer close(stopped)
+		if err := startRelayServer(ctx, server); err != nil {
+			fmt.Println("Unable to start RelayServer:", err)
 			return
 		}
 	}()
 
 	fmt.Println("Relay Server Started...")
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	cancel()
+
+	// Wait for the connections to drain before exiting
+	<-stopped
+}
+
+// startRelayServer runs the server on the socket passed in by systemd when the relay is
+// socket activated, and otherwise listens on the server's address.
+func startRelayServer(ctx context.Context, server *relay.Server) error {
+	listeners, err := hero.SystemdListeners()
+	if err != nil {
+		return err
+	}
+
+	if len(listeners) == 0 {
+		return server.Start(ctx)
+	}
+
+	for _, l := range listeners[1:] {
+		// Only a single socket is supported
+		_ = l.Close()
+	}
+
+	fmt.Println("Using socket from systemd:", listeners[0].Addr())
+	return server.Serve(ctx, listeners[0])
+}
+
+// relayTLSConfig builds the TLS config from the flags. It returns nil when TLS
+// wasn't asked for.
+func relayTLSConfig() (*tls.Config, error) {
+	if relaySelfSigned {
+		if err := createSelfSignedCert(); err != nil {
+			return nil, err
+		}
+	}
+
+	if relayCertFile == "" && relayKeyFile == "" {
+		return nil, nil
+	}
+
+	config, err := hero.ServerTLSConfig(relayCertFile, relayKeyFile, relayClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("TLS certificate fingerprint:", hero.Fingerprint(config.Certificates[0]))
+	return config, nil
+}
+
+// createSelfSignedCert generates a self-signed certificate and key into --cert and
+// --key unless they already exist, so the fingerprint stays the same across restarts.
+// When no files were given they go in a temporary directory. The cert and key are a
+// pair, so giving only one of them is an error.
+func createSelfSignedCert() error {
+	if (relayCertFile == "") != (relayKeyFile == "") {
+		return fmt.Errorf("--self-signed needs both --cert and --key, or neither")
+	}
+
+	if relayCertFile == "" {
+		dir, err := ioutil.TempDir("", "ft-relay")
+		if err != nil {
+			return err
+		}
+		relayCertFile = filepath.Join(dir, "cert.pem")
+		relayKeyFile = filepath.Join(dir, "key.pem")
+	}
+
+	if _, err := os.Stat(relayCertFile); err == nil {
+		// Reuse the existing pair
+		return nil
+	}
+
+	certPEM, keyPEM, err := hero.GenerateSelfSignedCert("localhost", "127.0.0.1", "::1")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(relayCertFile, certPEM, 0644); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(relayKeyFile, keyPEM, 0600)
 }
@@ -17,6 +17,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
@@ -62,6 +63,18 @@ func init() {
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
+// bindFlagsToConfig lets each of the named flags of cmd be set in the config file or
+// the environment as well, under the flag's name with dashes replaced by underscores.
+// It is called when cmd runs rather than in init, since several commands have flags
+// for the same setting.
+func bindFlagsToConfig(cmd *cobra.Command, names ...string) {
+	for _, name := range names {
+		if err := viper.BindPFlag(strings.Replace(name, "-", "_", -1), cmd.Flags().Lookup(name)); err != nil {
+			fmt.Println("Unable to bind flag", name, err)
+		}
+	}
+}
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile != "" {
@@ -20,9 +20,11 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/gtarcea/ft/hero"
 	"github.com/gtarcea/ft/pkg/ft"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // sendCmd represents the send command
@@ -38,6 +40,8 @@ to quickly create a Cobra application.`,
 	Run: runSendCmd,
 }
 
+var relayFingerprint string
+
 func init() {
 	rootCmd.AddCommand(sendCmd)
 
@@ -50,11 +54,25 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// sendCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	sendCmd.Flags().StringVar(&relayFingerprint, "relay-fingerprint", "",
+		"Connect to the relay over TLS, checking its certificate has this SHA-256 fingerprint")
+	sendCmd.Flags().String("relay-password", ft.DefaultClientOpts.RelayPassword,
+		"Password to authenticate with the relay (config: relay_password)")
+	sendCmd.Flags().String("app-id", ft.DefaultClientOpts.AppID, "App ID to authenticate with the relay (config: app_id)")
+	sendCmd.Flags().String("slot-secret", "", "Secret for the relay key, shared with the receiver (config: slot_secret)")
 }
 
 func runSendCmd(cmd *cobra.Command, args []string) {
 	fmt.Println("send called")
-	c := ft.NewClient(nil)
+	bindFlagsToConfig(cmd, "relay-password", "app-id", "slot-secret")
+	opts := ft.DefaultClientOpts
+	opts.RelayPassword = viper.GetString("relay_password")
+	opts.AppID = viper.GetString("app_id")
+	opts.SlotSecret = viper.GetString("slot_secret")
+	if relayFingerprint != "" {
+		opts.TLSConfig = hero.PinnedTLSConfig(relayFingerprint)
+	}
+	c := ft.NewClient(&opts)
 	if err := c.ConnectToRelay(); err != nil {
 		fmt.Println("Unable to connect to relay server")
 	}
@@ -0,0 +1,270 @@
+package hero
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/gtarcea/ft/internal/network"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// CipherSuite is an AEAD that frames can be encrypted with once encryption is turned
+// on. Suites are picked by name during the PAKE handshake, so both sides have to agree
+// on the name.
+type CipherSuite struct {
+	Name string
+
+	// NewAEAD creates the AEAD for a key. Both built in suites take 32 byte keys.
+	NewAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+var (
+	// AES256GCM is the default suite. It is the fastest choice on hardware with AES
+	// instructions.
+	AES256GCM = CipherSuite{Name: "aes-256-gcm", NewAEAD: newAES256GCM}
+
+	// ChaCha20Poly1305 is much faster than AES-GCM on hardware without AES instructions,
+	// such as many ARM boards.
+	ChaCha20Poly1305 = CipherSuite{Name: "chacha20-poly1305", NewAEAD: chacha20poly1305.New}
+)
+
+func newAES256GCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("aes-256-gcm needs a 32 byte key, got %d bytes", len(key))
+	}
+
+	return network.NewAESGCM(key)
+}
+
+// ChooseCipherSuite picks the suite to use from the names a peer offered. The peer's
+// order of preference wins, since it is the side that knows what its hardware is good
+// at. It returns false if none of the offered suites are in CipherSuites.
+func (h *Hero) ChooseCipherSuite(offered []string) (CipherSuite, bool) {
+	for _, name := range offered {
+		if suite, ok := h.findCipherSuite(name); ok {
+			return suite, true
+		}
+	}
+
+	return CipherSuite{}, false
+}
+
+// CipherSuiteNames returns the names of CipherSuites, in order, for offering to a peer.
+func (h *Hero) CipherSuiteNames() []string {
+	var names []string
+	for _, suite := range h.CipherSuites {
+		names = append(names, suite.Name)
+	}
+
+	return names
+}
+
+func (h *Hero) findCipherSuite(name string) (CipherSuite, bool) {
+	for _, suite := range h.CipherSuites {
+		if suite.Name == name {
+			return suite, true
+		}
+	}
+
+	return CipherSuite{}, false
+}
+
+const (
+	// DefaultRekeyAfterBytes is how many bytes are sent with a key before moving on to
+	// the next one.
+	DefaultRekeyAfterBytes int64 = 1 << 30
+
+	// DefaultRekeyAfterFrames is how many frames are sent with a key before moving on
+	// to the next one.
+	DefaultRekeyAfterFrames int64 = 1 << 20
+)
+
+// FrameCipher encrypts and decrypts the frames for one end of a connection. The
+// session key from the key exchange is split into a key for each direction, and
+// frames in each direction are numbered, so a frame that is replayed, dropped or
+// reordered fails to decrypt. A FrameCipher must only be used for one connection, and
+// only by one writer and one reader at a time.
+//
+// Keys are rotated as they are used. Once RekeyAfterBytes or RekeyAfterFrames is
+// reached the sending key is replaced by one derived from it, and the frame that starts
+// using it is marked by flipping the key phase byte in front of every encrypted frame.
+// The receiver derives the same key when it sees the phase flip, so only the sender's
+// limits matter and the two ends don't have to be configured alike.
+type FrameCipher struct {
+	// RekeyAfterBytes and RekeyAfterFrames limit how much is sent with one key. Zero
+	// means no limit.
+	RekeyAfterBytes  int64
+	RekeyAfterFrames int64
+
+	// suite builds an AEAD for each key, which is kept in sendAEAD or recvAEAD until
+	// the key is rotated.
+	suite    *CipherSuite
+	sendAEAD cipher.AEAD
+	recvAEAD cipher.AEAD
+
+	sendKey []byte
+	recvKey []byte
+	sendSeq uint64
+	recvSeq uint64
+
+	// sendPhase and recvPhase are the key phase for each direction, which flips
+	// between 0 and 1 on every rekey. sentBytes and sentFrames count what has been sent
+	// with the current sending key.
+	sendPhase  byte
+	recvPhase  byte
+	sentBytes  int64
+	sentFrames int64
+}
+
+// NewFrameCipher creates the FrameCipher for one end of a connection from the session
+// key. The client and the server each send with the key the other receives with, so
+// isClient has to be different at the two ends.
+func NewFrameCipher(suite CipherSuite, sessionKey []byte, isClient bool) (*FrameCipher, error) {
+	return newFrameCipher(&suite, sessionKey, isClient)
+}
+
+// newFrameCipher creates a FrameCipher that uses suite, or AES256GCM when suite is nil.
+func newFrameCipher(suite *CipherSuite, sessionKey []byte, isClient bool) (*FrameCipher, error) {
+	if suite == nil {
+		suite = &AES256GCM
+	}
+
+	clientKey, err := deriveKey(sessionKey, "hero client to server")
+	if err != nil {
+		return nil, err
+	}
+
+	serverKey, err := deriveKey(sessionKey, "hero server to client")
+	if err != nil {
+		return nil, err
+	}
+
+	fc := &FrameCipher{
+		RekeyAfterBytes:  DefaultRekeyAfterBytes,
+		RekeyAfterFrames: DefaultRekeyAfterFrames,
+		suite:            suite,
+		sendKey:          serverKey,
+		recvKey:          clientKey,
+	}
+	if isClient {
+		fc.sendKey, fc.recvKey = clientKey, serverKey
+	}
+
+	return fc, nil
+}
+
+// Seal encrypts the next frame to send, rotating the sending key first if it has been
+// used up.
+func (fc *FrameCipher) Seal(frame []byte) ([]byte, error) {
+	if fc.sendKeyUsedUp() {
+		key, err := nextKey(fc.sendKey)
+		if err != nil {
+			return nil, err
+		}
+		fc.sendKey, fc.sendAEAD = key, nil
+		fc.sendPhase ^= 1
+		fc.sentBytes, fc.sentFrames = 0, 0
+	}
+
+	encrypted, err := fc.seal(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	fc.sendSeq++
+	fc.sentFrames++
+	fc.sentBytes += int64(len(frame))
+	return append([]byte{fc.sendPhase}, encrypted...), nil
+}
+
+// Open decrypts the next frame received. It fails if the frame isn't the one that
+// was expected next. A frame with the key phase flipped is decrypted with the next
+// key, which replaces the current one once the frame has been decrypted.
+func (fc *FrameCipher) Open(frame []byte) ([]byte, error) {
+	if len(frame) == 0 {
+		return nil, fmt.Errorf("frame %d is empty", fc.recvSeq)
+	}
+
+	key, aead := fc.recvKey, fc.recvAEAD
+	phase := frame[0]
+	switch phase {
+	case fc.recvPhase:
+	case fc.recvPhase ^ 1:
+		var err error
+		if key, err = nextKey(fc.recvKey); err != nil {
+			return nil, err
+		}
+		aead = nil
+	default:
+		return nil, fmt.Errorf("frame %d has unknown key phase %d", fc.recvSeq, phase)
+	}
+
+	decrypted, aead, err := fc.open(key, aead, frame[1:])
+	if err != nil {
+		return nil, fmt.Errorf("frame %d failed to decrypt: %s", fc.recvSeq, err)
+	}
+
+	fc.recvKey, fc.recvAEAD = key, aead
+	fc.recvPhase = phase
+	fc.recvSeq++
+	return decrypted, nil
+}
+
+func (fc *FrameCipher) sendKeyUsedUp() bool {
+	return (fc.RekeyAfterBytes > 0 && fc.sentBytes >= fc.RekeyAfterBytes) ||
+		(fc.RekeyAfterFrames > 0 && fc.sentFrames >= fc.RekeyAfterFrames)
+}
+
+// seal encrypts frame with the sending key, building the key's AEAD the first time
+// it is used.
+func (fc *FrameCipher) seal(frame []byte) ([]byte, error) {
+	if fc.sendAEAD == nil {
+		aead, err := fc.suite.NewAEAD(fc.sendKey)
+		if err != nil {
+			return nil, err
+		}
+		fc.sendAEAD = aead
+	}
+
+	return network.SealFrame(fc.sendAEAD, fc.sendSeq, frame)
+}
+
+// open decrypts frame with key. aead is the AEAD already built for key, if there is one.
+// The AEAD that was used is returned so it can be kept along with the key.
+func (fc *FrameCipher) open(key []byte, aead cipher.AEAD, frame []byte) ([]byte, cipher.AEAD, error) {
+	if aead == nil {
+		var err error
+		if aead, err = fc.suite.NewAEAD(key); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	decrypted, err := network.OpenFrame(aead, fc.recvSeq, frame)
+	return decrypted, aead, err
+}
+
+// setSuite switches the suite frames are encrypted with, keeping the keys and sequence
+// numbers.
+func (fc *FrameCipher) setSuite(suite *CipherSuite) {
+	fc.suite = suite
+	fc.sendAEAD, fc.recvAEAD = nil, nil
+}
+
+// deriveKey derives a 32 byte key for label from the session key with HKDF-SHA256.
+func deriveKey(sessionKey []byte, label string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sessionKey, nil, []byte(label)), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// nextKey derives the key that replaces key when it is rotated. The old key can't be
+// worked out from the new one.
+func nextKey(key []byte) ([]byte, error) {
+	return deriveKey(key, "hero rekey")
+}
@@ -0,0 +1,301 @@
+package hero
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCipherSuitesRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, suite := range []CipherSuite{AES256GCM, ChaCha20Poly1305} {
+		t.Run(suite.Name, func(t *testing.T) {
+			client, err := NewFrameCipher(suite, key, true)
+			assert.Nil(t, err)
+			server, err := NewFrameCipher(suite, key, false)
+			assert.Nil(t, err)
+
+			sealed, err := client.Seal([]byte("hello"))
+			assert.Nil(t, err)
+			assert.NotContains(t, string(sealed), "hello")
+
+			opened, err := server.Open(sealed)
+			assert.Nil(t, err)
+			assert.Equal(t, "hello", string(opened))
+		})
+	}
+
+	// A frame sealed with one suite can't be opened with the other
+	client, err := NewFrameCipher(ChaCha20Poly1305, key, true)
+	assert.Nil(t, err)
+	server, err := NewFrameCipher(AES256GCM, key, false)
+	assert.Nil(t, err)
+	sealed, err := client.Seal([]byte("hello"))
+	assert.Nil(t, err)
+	_, err = server.Open(sealed)
+	assert.NotNil(t, err)
+}
+
+func TestFrameCipherWithoutASuiteUsesAES256GCM(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	client, err := newFrameCipher(nil, key, true)
+	assert.Nil(t, err)
+	server, err := NewFrameCipher(AES256GCM, key, false)
+	assert.Nil(t, err)
+
+	sealed, err := client.Seal([]byte("hello"))
+	assert.Nil(t, err)
+	aead := client.sendAEAD
+	opened, err := server.Open(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(opened))
+
+	// The AEAD is kept for the next frame rather than built again
+	_, err = client.Seal([]byte("again"))
+	assert.Nil(t, err)
+	assert.True(t, aead == client.sendAEAD)
+}
+
+func TestChooseCipherSuiteUsesPeerPreference(t *testing.T) {
+	h := NewHero("")
+	suite, ok := h.ChooseCipherSuite([]string{"unknown", ChaCha20Poly1305.Name, AES256GCM.Name})
+	assert.True(t, ok)
+	assert.Equal(t, ChaCha20Poly1305.Name, suite.Name)
+
+	_, ok = h.ChooseCipherSuite([]string{"unknown"})
+	assert.False(t, ok)
+}
+
+func TestConnectionsUseTheirCipherSuite(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := bytes.Repeat([]byte{7}, 32)
+	server := NewHero("")
+	server.Action("echo", func(c Context) error {
+		var body string
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		return c.JSON("echo", body)
+	})
+	s := newConnection(ctx, server, serverConn)
+	assert.Nil(t, s.ctx.SetCipherSuite(ChaCha20Poly1305.Name))
+	s.ctx.SetEncryptionKey(key)
+	assert.Nil(t, s.ctx.TurnEncryptionOn())
+	go s.handleConnection()
+
+	client := newConnection(ctx, NewHero(""), clientConn)
+	client.ctx.isClient = true
+	assert.Nil(t, client.ctx.SetCipherSuite(ChaCha20Poly1305.Name))
+	client.ctx.SetEncryptionKey(key)
+	assert.Nil(t, client.ctx.TurnEncryptionOn())
+	go client.handleConnection()
+
+	callCtx, callCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer callCancel()
+	var reply string
+	assert.Nil(t, client.ctx.Call(callCtx, "echo", "hello", &reply))
+	assert.Equal(t, "hello", reply)
+
+	assert.NotNil(t, client.ctx.SetCipherSuite("unknown"))
+}
+
+func TestConnHelpersTalkToEncryptedConnections(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := bytes.Repeat([]byte{7}, 32)
+	server := NewHero("")
+	server.Action("echo", func(c Context) error {
+		var body string
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		return c.JSON("echo", body)
+	})
+	s := newConnection(ctx, server, serverConn)
+	s.ctx.SetEncryptionKey(key)
+	assert.Nil(t, s.ctx.TurnEncryptionOn())
+	go s.handleConnection()
+
+	fc, err := NewFrameCipher(AES256GCM, key, true)
+	assert.Nil(t, err)
+	_, err = WriteMsgToConn(clientConn, "echo", "hello", fc)
+	assert.Nil(t, err)
+
+	msg, err := ReadMsgFromConn(clientConn, fc)
+	assert.Nil(t, err)
+	assert.Equal(t, "echo", msg.Action)
+	assert.Equal(t, `"hello"`, string(msg.Body))
+}
+
+func TestFrameCipherRejectsReplayedAndReorderedFrames(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	client, err := NewFrameCipher(AES256GCM, key, true)
+	assert.Nil(t, err)
+	server, err := NewFrameCipher(AES256GCM, key, false)
+	assert.Nil(t, err)
+
+	first, err := client.Seal([]byte("first"))
+	assert.Nil(t, err)
+	second, err := client.Seal([]byte("second"))
+	assert.Nil(t, err)
+
+	// Out of order
+	_, err = server.Open(second)
+	assert.NotNil(t, err)
+
+	b, err := server.Open(first)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(b))
+
+	// Replayed
+	_, err = server.Open(first)
+	assert.NotNil(t, err)
+
+	b, err = server.Open(second)
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(b))
+}
+
+func TestFrameCipherUsesAKeyForEachDirection(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	client, err := NewFrameCipher(ChaCha20Poly1305, key, true)
+	assert.Nil(t, err)
+	server, err := NewFrameCipher(ChaCha20Poly1305, key, false)
+	assert.Nil(t, err)
+	assert.NotEqual(t, client.sendKey, server.sendKey)
+	assert.NotEqual(t, key, client.sendKey)
+
+	// A frame reflected back to its sender doesn't decrypt.
+	frame, err := client.Seal([]byte("hello"))
+	assert.Nil(t, err)
+	_, err = client.Open(frame)
+	assert.NotNil(t, err)
+
+	reply, err := server.Seal([]byte("hi"))
+	assert.Nil(t, err)
+	b, err := client.Open(reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "hi", string(b))
+}
+
+func TestFrameCipherRotatesKeys(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	client, err := NewFrameCipher(AES256GCM, key, true)
+	assert.Nil(t, err)
+	client.RekeyAfterFrames = 2
+	client.RekeyAfterBytes = 0
+	server, err := NewFrameCipher(AES256GCM, key, false)
+	assert.Nil(t, err)
+	firstKey := client.sendKey
+
+	for i := 0; i < 5; i++ {
+		frame, err := client.Seal([]byte("hello"))
+		assert.Nil(t, err)
+		assert.Equal(t, byte(i/2%2), frame[0])
+
+		b, err := server.Open(frame)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(b))
+		assert.Equal(t, client.sendKey, server.recvKey)
+	}
+	assert.NotEqual(t, firstKey, client.sendKey)
+
+	// Rotating on bytes works the same way
+	client.RekeyAfterFrames = 0
+	client.RekeyAfterBytes = 8
+	for i := 0; i < 3; i++ {
+		frame, err := client.Seal([]byte("hello"))
+		assert.Nil(t, err)
+		_, err = server.Open(frame)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, client.sendPhase, server.recvPhase)
+	assert.Equal(t, client.sendKey, server.recvKey)
+
+	// A frame can't claim a phase that skips ahead
+	frame, err := client.Seal([]byte("hello"))
+	assert.Nil(t, err)
+	frame[0] = 2
+	_, err = server.Open(frame)
+	assert.NotNil(t, err)
+}
+
+func TestConnectionsRekeyWithoutHandlersNoticing(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := bytes.Repeat([]byte{7}, 32)
+	server := NewHero("")
+	server.RekeyAfterFrames = 1
+	server.Action("echo", func(c Context) error {
+		var body string
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		return c.JSON("echo", body)
+	})
+	s := newConnection(ctx, server, serverConn)
+	s.ctx.SetEncryptionKey(key)
+	assert.Nil(t, s.ctx.TurnEncryptionOn())
+	go s.handleConnection()
+
+	clientHero := NewHero("")
+	clientHero.RekeyAfterBytes = 64
+	client := newConnection(ctx, clientHero, clientConn)
+	client.ctx.isClient = true
+	client.ctx.SetEncryptionKey(key)
+	assert.Nil(t, client.ctx.TurnEncryptionOn())
+	go client.handleConnection()
+
+	for _, body := range []string{"one", "two", "three", "four"} {
+		callCtx, callCancel := context.WithTimeout(ctx, 3*time.Second)
+		var reply string
+		assert.Nil(t, client.ctx.Call(callCtx, "echo", body, &reply))
+		assert.Equal(t, body, reply)
+		callCancel()
+	}
+}
+
+func TestFrameCipherBuildsAnAEADForEachKey(t *testing.T) {
+	built := 0
+	countingSuite := CipherSuite{Name: "counting", NewAEAD: func(key []byte) (cipher.AEAD, error) {
+		built++
+		return AES256GCM.NewAEAD(key)
+	}}
+
+	key := bytes.Repeat([]byte{7}, 32)
+	client, err := NewFrameCipher(countingSuite, key, true)
+	assert.Nil(t, err)
+	client.RekeyAfterFrames = 4
+	server, err := NewFrameCipher(countingSuite, key, false)
+	assert.Nil(t, err)
+
+	// Ten frames rotate the key twice, so each end builds three AEADs
+	for i := 0; i < 10; i++ {
+		sealed, err := client.Seal([]byte("hello"))
+		assert.Nil(t, err)
+		_, err = server.Open(sealed)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 6, built)
+}
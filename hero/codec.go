@@ -0,0 +1,120 @@
+package hero
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Codec encodes and decodes hero messages and their bodies. Codecs are negotiated
+// by name when a client connects, so both sides have to agree on the name.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec is the default codec. Connections always start out using it, and
+	// stay on it unless both sides agree on another codec.
+	JSONCodec Codec = jsonCodec{}
+
+	// CBORCodec is a compact binary codec. Byte slices in the body are sent as
+	// is rather than being base64 encoded like they are with JSON.
+	CBORCodec Codec = cborCodec{}
+)
+
+// frameTypeMsg marks a frame holding a message encoded with the connection's negotiated
+// codec. JSON messages are sent without a frame type so older peers can read them, and
+// are recognized by starting with '{'.
+const frameTypeMsg byte = 0x01
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
+
+// encodeMessage turns m into the bytes for a frame. JSON is written as is, while other
+// codecs are prefixed with frameTypeMsg.
+func encodeMessage(codec Codec, m *Message) ([]byte, error) {
+	if isJSONCodec(codec) {
+		return json.Marshal(m)
+	}
+
+	b, err := codec.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{frameTypeMsg}, b...), nil
+}
+
+// decodeMessage decodes a frame into a message. JSON frames and data frames can always
+// be decoded. Frames for other codecs are decoded with codec, which is the codec
+// negotiated for the connection.
+func decodeMessage(b []byte, codec Codec) (*Message, error) {
+	var m Message
+	switch {
+	case len(b) == 0:
+		return &m, fmt.Errorf("empty frame")
+	case b[0] == '{':
+		m.codec = JSONCodec
+		return &m, json.Unmarshal(b, &m)
+	case b[0] == frameTypeMsg && !isJSONCodec(codec):
+		m.codec = codec
+		return &m, codec.Unmarshal(b[1:], &m)
+	case b[0] == frameTypeData:
+		return decodeDataFrame(b)
+	default:
+		return &m, fmt.Errorf("unknown frame type %d", b[0])
+	}
+}
+
+func isJSONCodec(codec Codec) bool {
+	return codec == nil || codec.Name() == JSONCodec.Name()
+}
+
+// findCodec returns the codec in codecs with the given name, or nil if there isn't one.
+func findCodec(codecs []Codec, name string) Codec {
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec
+		}
+	}
+
+	return nil
+}
+
+// codecNames returns the names of codecs, in order.
+func codecNames(codecs []Codec) []string {
+	var names []string
+	for _, codec := range codecs {
+		names = append(names, codec.Name())
+	}
+
+	return names
+}
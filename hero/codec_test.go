@@ -0,0 +1,68 @@
+package hero
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type chunk struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	tests := []struct {
+		name          string
+		clientCodecs  []Codec
+		serverCodecs  []Codec
+		expectedCodec Codec
+	}{
+		{name: "both support cbor", clientCodecs: []Codec{CBORCodec, JSONCodec}, serverCodecs: []Codec{JSONCodec, CBORCodec}, expectedCodec: CBORCodec},
+		{name: "server only json", clientCodecs: []Codec{CBORCodec, JSONCodec}, serverCodecs: []Codec{JSONCodec}, expectedCodec: JSONCodec},
+		{name: "client only json", clientCodecs: []Codec{JSONCodec}, serverCodecs: []Codec{CBORCodec, JSONCodec}, expectedCodec: JSONCodec},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+
+			server := NewHero("")
+			server.Codecs = test.serverCodecs
+			server.Action("chunk", func(c Context) error {
+				var req chunk
+				if err := c.Bind(&req); err != nil {
+					return err
+				}
+				return c.JSON("chunk", req)
+			})
+			serverConnection := newConnection(ctx, server, serverConn)
+			go serverConnection.handleConnection()
+
+			client := NewHero("")
+			client.Codecs = test.clientCodecs
+			clientConnection := newConnection(ctx, client, clientConn)
+			clientConnection.ctx.isClient = true
+			go clientConnection.handleConnection()
+
+			// The first call negotiates the codec, and the second one uses it.
+			for i := 0; i < 2; i++ {
+				req := chunk{Name: "chunk", Data: []byte{0, 1, 2, 3}}
+				var resp chunk
+				assert.Nil(t, clientConnection.ctx.Call(ctx, "chunk", req, &resp))
+				assert.Equal(t, req, resp)
+			}
+
+			assert.Equal(t, test.expectedCodec, clientConnection.ctx.Codec())
+			assert.Equal(t, test.expectedCodec, serverConnection.ctx.Codec())
+		})
+	}
+}
@@ -1,69 +1,217 @@
 package hero
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/apex/log"
 	"github.com/gtarcea/ft/internal/network"
 )
 
+// Message is the envelope for everything sent over a hero connection. ID is optional,
+// and is set when the sender wants to match up the reply. A reply carries the ID of
+// the message it answers in ReplyTo.
 type Message struct {
-	Action string `json:"action"`
-	Error  string `json:"error"`
-	Body   []byte `json:"body"`
+	ID      string `json:"id,omitempty"`
+	ReplyTo string `json:"reply_to,omitempty"`
+	Action  string `json:"action"`
+	Error   string `json:"error"`
+	Body    []byte `json:"body"`
+
+	// ErrorCode and ErrorDetails carry the rest of a hero.Error.
+	ErrorCode    string            `json:"error_code,omitempty"`
+	ErrorDetails map[string]string `json:"error_details,omitempty"`
+
+	// Codecs is sent by a client in its first message to offer the codecs it can use. The
+	// server sends back the one it picked in Codec, and both sides then switch to it.
+	Codecs []string `json:"codecs,omitempty"`
+	Codec  string   `json:"codec,omitempty"`
+
+	// codec is the codec the message was decoded with, and is used to decode the Body.
+	codec Codec
+
+	// data is the payload when the message came from a data frame.
+	data   []byte
+	isData bool
+}
+
+// decodeBody decodes the message body into i using the codec the message was sent with.
+func (m *Message) decodeBody(i interface{}) error {
+	codec := m.codec
+	if codec == nil {
+		codec = JSONCodec
+	}
+
+	return codec.Unmarshal(m.Body, i)
 }
 
 type connection struct {
 	conn net.Conn
 	ctx  *ctx
+
+	// busy is true while an action is running. mu protects busy and makes sure
+	// shutdown doesn't close a connection out from under an action.
+	busy bool
+	mu   sync.Mutex
 }
 
-func newConnection(h *Hero, conn net.Conn) *connection {
-	return &connection{
+// newConnection creates a connection whose context is derived from parent. The
+// context is cancelled when the connection closes.
+func newConnection(parent context.Context, h *Hero, conn net.Conn) *connection {
+	c := &connection{
 		ctx:  newCtx(h, conn),
 		conn: conn,
 	}
+	c.ctx.connContext, c.ctx.cancel = context.WithCancel(parent)
+	c.ctx.id = strconv.FormatUint(atomic.AddUint64(&h.lastConnectionID, 1), 10)
+	return c
+}
+
+// serve runs the connect hooks for a connection that was accepted and then handles it.
+// A connection rejected by a connect hook is closed without running the disconnect hooks.
+func (c *connection) serve() {
+	if err := c.ctx.hero.runConnectHooks(c.ctx); err != nil {
+		log.Debugf("Connection from %s rejected: %s", c.conn.RemoteAddr(), err)
+		c.ctx.cancel()
+		_ = c.conn.Close()
+		c.ctx.hero.untrackConnection(c)
+		return
+	}
+
+	c.handleConnection()
 }
 
 func (c *connection) handleConnection() {
+	defer c.finish()
+	if interval := c.ctx.hero.HeartbeatInterval; interval > 0 {
+		go c.heartbeat(interval)
+	}
+
 	for {
 		select {
-		case <-c.ctx.hero.context.Done():
-			_ = c.conn.Close()
+		case <-c.ctx.connContext.Done():
+			return
+		case <-c.ctx.hero.quit:
 			return
 		default:
 			msg, err := c.readMsg()
 			switch {
 			case err == io.EOF:
-				_ = c.conn.Close()
 				return
-			case err != nil:
+			case err != nil && msg != nil:
+				// The message couldn't be decoded, skip it
+				log.Debugf("Unable to decode message: %s", err)
 				continue
+			case err != nil:
+				if c.ctx.connContext.Err() == nil && !c.ctx.hero.isShuttingDown() {
+					c.ctx.hero.runErrorHooks(c.ctx, err)
+				}
+				return
 			default:
 			}
+
+			if err := msg.Err(); err != nil && msg.Action == "" {
+				// An error reply that no call is waiting on. Answering it would only send
+				// another error back, so hand it to the error hooks instead.
+				c.ctx.hero.runErrorHooks(c.ctx, err)
+				continue
+			}
+
+			if !c.startAction() {
+				// Hero is shutting down so don't start anything new
+				return
+			}
+
 			if err := c.runMsgAction(msg); err != nil {
 				log.Debugf("Action returned error: %s", err)
+				c.ctx.hero.runErrorHooks(c.ctx, err)
 				if _, err := c.writeError(err); err != nil {
 					log.Debugf("Unable to write error to connection, got error: %s", err)
 				}
 			}
+
+			c.finishAction()
+
+			if c.ctx.isHijacked() {
+				// The handler has taken over the connection, so stop processing messages
+				// and leave the connection open.
+				return
+			}
 		}
 	}
 }
 
+// finish cleans up once hero is done with the connection. Unless the connection
+// was hijacked it is closed and the disconnect hooks are run.
+func (c *connection) finish() {
+	c.ctx.cancel()
+	c.ctx.closePending()
+	if !c.ctx.isHijacked() {
+		_ = c.conn.Close()
+		c.ctx.hero.runDisconnectHooks(c.ctx)
+	}
+	c.ctx.hero.untrackConnection(c)
+}
+
+// startAction marks the connection as busy. It returns false if hero is shutting
+// down, in which case the message should not be run.
+func (c *connection) startAction() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ctx.hero.isShuttingDown() {
+		return false
+	}
+
+	c.busy = true
+	return true
+}
+
+func (c *connection) finishAction() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy = false
+}
+
+// closeIfIdle closes the connection if it isn't running an action. Busy connections
+// notice the shutdown once their action finishes.
+func (c *connection) closeIfIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.busy {
+		_ = c.conn.Close()
+	}
+}
+
 func (c *connection) runMsgAction(msg *Message) error {
+	c.ctx.msg = msg
 	if action := c.getActionForMessageAction(msg.Action); action != nil {
-		c.ctx.msg = msg
-		if err := c.runMiddleware(); err != nil {
-			return err
+		var (
+			msgContext context.Context
+			cancel     context.CancelFunc
+		)
+		if action.timeout > 0 {
+			msgContext, cancel = context.WithTimeout(c.ctx.connContext, action.timeout)
+		} else {
+			msgContext, cancel = context.WithCancel(c.ctx.connContext)
 		}
-		return action.handler(c.ctx)
+		c.ctx.setContext(msgContext)
+		defer func() {
+			cancel()
+			c.ctx.setContext(nil)
+		}()
+
+		return action.chain(c.ctx.hero.middleware)(c.ctx)
 	}
 
-	return fmt.Errorf("no such action: %s", msg.Action)
+	return NewError(ErrCodeNoSuchAction, fmt.Sprintf("no such action: %s", msg.Action))
 }
 
 func (c *connection) getActionForMessageAction(msgAction string) *action {
@@ -74,79 +222,85 @@ func (c *connection) getActionForMessageAction(msgAction string) *action {
 	return nil
 }
 
-func (c *connection) runMiddleware() error {
-	for i := len(c.ctx.hero.middleware); i > 0; i-- {
-		if err := c.ctx.hero.middleware[i-1](c.ctx); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 func (c *connection) readMsg() (*Message, error) {
-	return ReadMsgFromConn(c.conn, c.ctx.encryptionOn, c.ctx.encryptionKey)
-}
-
-func (c *connection) writeMsg(action string, body interface{}) (int, error) {
-	return WriteMsgToConn(c.conn, action, body, c.ctx.encryptionOn, c.ctx.encryptionKey)
+	return c.ctx.readMsg()
 }
 
 func (c *connection) writeError(err error) (int, error) {
-	return WriteErrorToConn(c.conn, err, c.ctx.encryptionOn, c.ctx.encryptionKey)
+	return c.ctx.writeError(err)
 }
 
 ///////////////// Write ///////////////////
 
-func WriteErrorToConn(conn net.Conn, err error, isEncrypted bool, encryptionKey []byte) (int, error) {
-	m := Message{Error: fmt.Sprintf("%s", err)}
-	msgBytes, err := json.Marshal(m)
-	if err != nil {
-		return 0, err
-	}
-
-	if isEncrypted {
-		return network.WriteEncrypted(conn, msgBytes, encryptionKey)
-	}
-
-	return network.Write(conn, msgBytes)
+// WriteErrorToConn writes err to conn as a JSON message. If fc isn't nil the frame
+// is sealed with it, so it can be read by a hero connection sharing fc's key.
+func WriteErrorToConn(conn net.Conn, err error, fc *FrameCipher) (int, error) {
+	var m Message
+	m.setError(err)
+	return writeMessageToConn(conn, &m, JSONCodec, fc)
 }
 
-func WriteMsgToConn(conn net.Conn, action string, body interface{}, isEncrypted bool, encryptionKey []byte) (int, error) {
+// WriteMsgToConn writes action and body to conn as a JSON message, sealing it with fc
+// when fc isn't nil.
+func WriteMsgToConn(conn net.Conn, action string, body interface{}, fc *FrameCipher) (int, error) {
 	b, err := json.Marshal(body)
 	if err != nil {
 		return 0, err
 	}
 
 	m := Message{Action: action, Body: b}
-	msgBytes, err := json.Marshal(m)
+	return writeMessageToConn(conn, &m, JSONCodec, fc)
+}
+
+func writeMessageToConn(conn net.Conn, m *Message, codec Codec, fc *FrameCipher) (int, error) {
+	msgBytes, err := encodeMessage(codec, m)
 	if err != nil {
 		return 0, err
 	}
 
-	if isEncrypted {
-		return network.WriteEncrypted(conn, msgBytes, encryptionKey)
+	return writeFrameToConn(conn, msgBytes, fc)
+}
+
+func writeFrameToConn(conn net.Conn, frame []byte, fc *FrameCipher) (int, error) {
+	if fc != nil {
+		encrypted, err := fc.Seal(frame)
+		if err != nil {
+			return 0, err
+		}
+		frame = encrypted
 	}
 
-	return network.Write(conn, msgBytes)
+	return network.Write(conn, frame)
 }
 
 ///////////////// Read ///////////////////
 
-func ReadMsgFromConn(conn net.Conn, isEncrypted bool, encryptionKey []byte) (*Message, error) {
-	b, _, err := readFromConn(conn, isEncrypted, encryptionKey)
+// ReadMsgFromConn reads a JSON message written by WriteMsgToConn, opening it with fc
+// when fc isn't nil.
+func ReadMsgFromConn(conn net.Conn, fc *FrameCipher) (*Message, error) {
+	return readMessageFromConn(network.NewFrameReader(conn), JSONCodec, fc)
+}
+
+func readMessageFromConn(fr *network.FrameReader, codec Codec, fc *FrameCipher) (*Message, error) {
+	b, err := readFromConn(fr, fc)
 	if err != nil {
 		return nil, err
 	}
 
-	var m Message
-	err = json.Unmarshal(b, &m)
-	return &m, err
+	return decodeMessage(b, codec)
 }
 
-func readFromConn(conn net.Conn, isEncrypted bool, encryptionKey []byte) ([]byte, int, error) {
-	if isEncrypted {
-		return network.ReadAndDecrypt(conn, encryptionKey)
+func readFromConn(fr *network.FrameReader, fc *FrameCipher) ([]byte, error) {
+	b, err := fr.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	if fc == nil {
+		// The reader reuses its buffer for the next frame, and data frames keep a slice
+		// of it, so frames read in the clear are copied out. Decrypting makes a new slice.
+		return append([]byte(nil), b...), nil
 	}
 
-	return network.Read(conn)
+	return fc.Open(b)
 }
@@ -1,18 +1,34 @@
 package hero
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/gtarcea/ft/internal/network"
 )
 
+// ErrConnectionClosed is returned to calls that are waiting on a reply when the connection closes.
+var ErrConnectionClosed = errors.New("connection closed")
+
+// ErrConnectionHijacked is returned when sending to a connection that has been hijacked.
+var ErrConnectionHijacked = errors.New("connection hijacked")
+
 type Context interface {
 	SetEncryptionKey(key []byte)
 	GetEncryptionKey() []byte
 	TurnEncryptionOn() error
 	TurnEncryptionOff() error
+	SetCipherSuite(name string) error
 	RemoteAddr() net.Addr
+	ID() string
 	Get(key string) interface{}
 	Set(key string, value interface{})
 	Bind(i interface{}) error
@@ -21,24 +37,90 @@ type Context interface {
 	JSON(string, interface{}) error
 	WriteMsg(action string, body interface{}) error
 	ReadMsg(i interface{}) error
+	Call(reqCtx context.Context, action string, req, resp interface{}) error
 	Action() string
+	Hijack() net.Conn
+	Context() context.Context
+	Codec() Codec
+	DataReader() io.Reader
+	DataWriter(action string) io.Writer
+	WriteData(action string, data []byte) error
 }
 
 type ctx struct {
+	// context is the context for the message being handled, and is nil between
+	// messages. It is derived from connContext, which is cancelled when the connection
+	// closes or hero shuts down. It is protected by contextMu since a Context can be
+	// kept and used after its handler returns.
+	context     context.Context
+	contextMu   sync.Mutex
+	connContext context.Context
+	cancel      context.CancelFunc
+
+	// id identifies the connection to Hero.Send.
+	id string
+
 	hero          *Hero
 	store         *sync.Map
 	conn          net.Conn
+	frames        *network.FrameReader
 	msg           *Message
 	encryptionKey []byte
 	encryptionOn  bool
+
+	// cipherSuite is the suite picked with SetCipherSuite. It is nil until then, and
+	// frames are encrypted with AES256GCM.
+	cipherSuite *CipherSuite
+
+	// frameCipher is created the first time encryption is turned on, and kept when it
+	// is turned off and on again so sequence numbers are never reused with a key.
+	frameCipher *FrameCipher
+	hijacked    bool
+	isClient    bool
+
+	// codec is the codec used for messages on the connection. acceptedCodec is set
+	// on the server side when it has picked one of the codecs offered by the client,
+	// and is switched to once the reply naming it has been sent. codecOffered is set
+	// on the client side once it has offered its codecs. These are protected by codecMu
+	// rather than writeMu so reading never waits on a blocked write.
+	codec         Codec
+	acceptedCodec Codec
+	codecOffered  bool
+	codecMu       sync.Mutex
+
+	// writeMu serializes writes so calls made from other goroutines don't
+	// interleave with replies written by handlers.
+	writeMu sync.Mutex
+
+	// lastID is the last message ID handed out by Call. It is accessed atomically.
+	lastID uint64
+
+	// pending holds the calls waiting on a reply, keyed by the ID of the request.
+	pending   map[string]chan *Message
+	pendingMu sync.Mutex
 }
 
 func newCtx(hero *Hero, conn net.Conn) *ctx {
-	return &ctx{hero: hero, conn: conn}
+	frames := network.NewFrameReader(conn)
+	frames.MaxFrameSize = hero.MaxFrameSize
+
+	return &ctx{
+		connContext: context.Background(),
+		cancel:      func() {},
+		hero:        hero,
+		conn:        conn,
+		frames:      frames,
+		store:       &sync.Map{},
+		pending:     make(map[string]chan *Message),
+		codec:       JSONCodec,
+	}
 }
 
 func (c *ctx) SetEncryptionKey(key []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	c.encryptionKey = key
+	c.frameCipher = nil
 }
 
 func (c *ctx) GetEncryptionKey() []byte {
@@ -50,6 +132,18 @@ func (c *ctx) TurnEncryptionOn() error {
 		return fmt.Errorf("no encryption key")
 	}
 
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.frameCipher == nil {
+		fc, err := newFrameCipher(c.cipherSuite, c.encryptionKey, c.isClient)
+		if err != nil {
+			return err
+		}
+		fc.RekeyAfterBytes = c.hero.RekeyAfterBytes
+		fc.RekeyAfterFrames = c.hero.RekeyAfterFrames
+		c.frameCipher = fc
+	}
+
 	c.encryptionOn = true
 	return nil
 }
@@ -59,10 +153,46 @@ func (c *ctx) TurnEncryptionOff() error {
 		return fmt.Errorf("no encryption key")
 	}
 
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	c.encryptionOn = false
 	return nil
 }
 
+// SetCipherSuite picks the suite from the hero's CipherSuites that frames are encrypted
+// with once encryption is on. It is normally called during the key exchange, with a
+// suite both sides agreed on.
+func (c *ctx) SetCipherSuite(name string) error {
+	suite, ok := c.hero.findCipherSuite(name)
+	if !ok {
+		return fmt.Errorf("unknown cipher suite: %s", name)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.cipherSuite = &suite
+	if c.frameCipher != nil {
+		c.frameCipher.setSuite(c.cipherSuite)
+	}
+
+	return nil
+}
+
+// activeCipher returns the cipher frames are encrypted with, or nil if encryption is off.
+func (c *ctx) activeCipher() *FrameCipher {
+	if !c.encryptionOn {
+		return nil
+	}
+
+	return c.frameCipher
+}
+
+// ID returns the ID hero gave the connection. It can be passed to Hero.Send to write
+// to the connection from another connection's handler.
+func (c *ctx) ID() string {
+	return c.id
+}
+
 func (c *ctx) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
@@ -77,7 +207,7 @@ func (c *ctx) Set(key string, value interface{}) {
 }
 
 func (c *ctx) Bind(i interface{}) error {
-	return json.Unmarshal(c.msg.Body, i)
+	return c.msg.decodeBody(i)
 }
 
 func (c *ctx) Hero() *Hero {
@@ -88,8 +218,11 @@ func (c *ctx) Conn() net.Conn {
 	return c.conn
 }
 
+// JSON writes a message for action with value as the body. Despite the name the body is
+// encoded with the connection's codec, which is JSON unless another has been negotiated.
+// If the message being handled was sent with an ID the message is marked as a reply to it.
 func (c *ctx) JSON(action string, value interface{}) error {
-	_, err := WriteMsgToConn(c.conn, action, value, c.encryptionOn, c.encryptionKey)
+	_, err := c.writeMessage(&Message{Action: action, ReplyTo: c.replyTo()}, value)
 	return err
 }
 
@@ -97,15 +230,310 @@ func (c *ctx) WriteMsg(action string, value interface{}) error {
 	return c.JSON(action, value)
 }
 
+// ReadMsg reads the next message into i. If the handler's context is done before a
+// whole message has been read the read is abandoned and the connection is closed,
+// since part of a frame may already have been read and it's no longer known where
+// the next message starts. The context's error is returned.
 func (c *ctx) ReadMsg(i interface{}) error {
-	msg, err := ReadMsgFromConn(c.conn, c.encryptionOn, c.encryptionKey)
-	if err != nil {
+	handlerContext := c.Context()
+	stop := make(chan struct{})
+	watching := make(chan struct{})
+	interrupted := false
+	go func() {
+		defer close(watching)
+		select {
+		case <-handlerContext.Done():
+			// Cut the read short rather than closing here, so the connection is only
+			// closed if the read didn't finish
+			interrupted = true
+			_ = c.conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	msg, err := c.readMsg()
+	close(stop)
+	<-watching
+
+	switch {
+	case err != nil && interrupted:
+		_ = c.conn.Close()
+		return handlerContext.Err()
+	case err != nil:
 		return err
+	case interrupted:
+		// The whole message arrived before the deadline took effect, so put back the
+		// usual one
+		_ = c.conn.SetReadDeadline(time.Time{})
+		c.setReadDeadline()
 	}
 
-	return json.Unmarshal(msg.Body, i)
+	if err := msg.Err(); err != nil {
+		return err
+	}
+
+	return msg.decodeBody(i)
+}
+
+// Call sends a request for action with req as the body, waits for the reply and
+// decodes the reply body into resp. Each request gets its own message ID, so many
+// calls can be in flight on a connection at once. Replies are read by the connection's
+// dispatch loop, which means Call has to be used from a goroutine other than the one
+// running the connection's handlers.
+func (c *ctx) Call(reqCtx context.Context, action string, req, resp interface{}) error {
+	id := strconv.FormatUint(atomic.AddUint64(&c.lastID, 1), 10)
+	replyc := c.addPending(id)
+	defer c.removePending(id)
+
+	if _, err := c.writeMessage(&Message{ID: id, Action: action}, req); err != nil {
+		return err
+	}
+
+	select {
+	case msg, ok := <-replyc:
+		if !ok {
+			return ErrConnectionClosed
+		}
+
+		switch err := msg.Err(); {
+		case err != nil:
+			return err
+		case resp == nil:
+			return nil
+		default:
+			return msg.decodeBody(resp)
+		}
+	case <-reqCtx.Done():
+		return reqCtx.Err()
+	}
 }
 
 func (c *ctx) Action() string {
 	return c.msg.Action
 }
+
+// push writes a message that isn't a reply, for Hero.Send and Hero.Broadcast. Hijacked
+// connections no longer belong to hero so nothing is written to them.
+func (c *ctx) push(action string, body interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.hijacked {
+		return ErrConnectionHijacked
+	}
+
+	m := &Message{Action: action}
+	_, err := c.writeMessageLocked(m, func(codec Codec) (err error) {
+		m.Body, err = codec.Marshal(body)
+		return err
+	})
+	return err
+}
+
+// Hijack takes the connection away from hero. Once the current handler returns hero
+// stops dispatching messages for the connection and will not close it. Hijacked
+// outside a handler, hero stops once it has dispatched the next message. The caller
+// is responsible for the connection from then on.
+func (c *ctx) Hijack() net.Conn {
+	// Taken so no heartbeat is being written when the caller takes over
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.hijacked = true
+	return c.conn
+}
+
+// isHijacked returns true once the connection has been hijacked, which can happen
+// from outside the connection's own goroutine.
+func (c *ctx) isHijacked() bool {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.hijacked
+}
+
+// replyTo returns the ID of the message being handled, which replies are sent in response to.
+func (c *ctx) replyTo() string {
+	if c.msg == nil {
+		return ""
+	}
+
+	return c.msg.ID
+}
+
+// Context returns the context for the message being handled. It is cancelled when
+// the handler returns, the action's timeout passes, the connection closes or hero
+// shuts down. Outside a handler, such as when a Context is kept after its handler
+// returns, it is the connection's context.
+func (c *ctx) Context() context.Context {
+	c.contextMu.Lock()
+	defer c.contextMu.Unlock()
+
+	if c.context != nil {
+		return c.context
+	}
+
+	return c.connContext
+}
+
+// setContext sets the context for the message being handled. Passing nil goes back to
+// the connection's context once the handler has returned.
+func (c *ctx) setContext(msgContext context.Context) {
+	c.contextMu.Lock()
+	c.context = msgContext
+	c.contextMu.Unlock()
+}
+
+// Codec returns the codec used for messages on the connection.
+func (c *ctx) Codec() Codec {
+	c.codecMu.Lock()
+	defer c.codecMu.Unlock()
+	return c.codec
+}
+
+// writeMessage encodes body with the connection's codec and writes m.
+func (c *ctx) writeMessage(m *Message, body interface{}) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.writeMessageLocked(m, func(codec Codec) (err error) {
+		m.Body, err = codec.Marshal(body)
+		return err
+	})
+}
+
+func (c *ctx) writeError(err error) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	m := &Message{ReplyTo: c.replyTo()}
+	m.setError(err)
+	return c.writeMessageLocked(m, nil)
+}
+
+// writeMessageLocked writes m, taking care of the codec negotiation. If encodeBody
+// is given it is called to fill in the body with the codec the message is sent with.
+// It must be called with writeMu held.
+func (c *ctx) writeMessageLocked(m *Message, encodeBody func(codec Codec) error) (int, error) {
+	c.codecMu.Lock()
+	codec := c.codec
+	switch {
+	case c.isClient && !c.codecOffered:
+		c.codecOffered = true
+		if codecs := c.hero.Codecs; len(codecs) > 1 || (len(codecs) == 1 && !isJSONCodec(codecs[0])) {
+			m.Codecs = codecNames(codecs)
+		}
+	case c.acceptedCodec != nil:
+		// The reply naming the codec is sent with the old codec. Everything after it
+		// uses the new one.
+		m.Codec = c.acceptedCodec.Name()
+		c.codec = c.acceptedCodec
+		c.acceptedCodec = nil
+	}
+	c.codecMu.Unlock()
+
+	if encodeBody != nil {
+		if err := encodeBody(codec); err != nil {
+			return 0, err
+		}
+	}
+
+	return writeMessageToConn(c.conn, m, codec, c.activeCipher())
+}
+
+// readMsg reads the next message sent on the connection. Replies to outstanding calls
+// are handed to the waiting call instead of being returned.
+func (c *ctx) readMsg() (*Message, error) {
+	for {
+		c.setReadDeadline()
+		msg, err := readMessageFromConn(c.frames, c.Codec(), c.activeCipher())
+		if err != nil {
+			return msg, err
+		}
+
+		if err := c.negotiateCodec(msg); err != nil {
+			return msg, err
+		}
+
+		if c.handleHeartbeat(msg) {
+			continue
+		}
+
+		if msg.ReplyTo == "" {
+			return msg, nil
+		}
+
+		if !c.deliverReply(msg) {
+			log.Debugf("Dropping reply to unknown message id %s", msg.ReplyTo)
+		}
+	}
+}
+
+// negotiateCodec handles the codec fields in a message. On the server it picks the
+// first codec offered by the client that hero also supports. On the client it switches
+// to the codec the server picked.
+func (c *ctx) negotiateCodec(msg *Message) error {
+	if len(msg.Codecs) == 0 && msg.Codec == "" {
+		return nil
+	}
+
+	c.codecMu.Lock()
+	defer c.codecMu.Unlock()
+
+	switch {
+	case c.isClient && msg.Codec != "":
+		codec := findCodec(c.hero.Codecs, msg.Codec)
+		if codec == nil {
+			return fmt.Errorf("server picked unknown codec %s", msg.Codec)
+		}
+		c.codec = codec
+
+	case !c.isClient && isJSONCodec(c.codec) && c.acceptedCodec == nil:
+		for _, name := range msg.Codecs {
+			if codec := findCodec(c.hero.Codecs, name); codec != nil {
+				if !isJSONCodec(codec) {
+					c.acceptedCodec = codec
+				}
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *ctx) addPending(id string) chan *Message {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	replyc := make(chan *Message, 1)
+	c.pending[id] = replyc
+	return replyc
+}
+
+func (c *ctx) removePending(id string) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	delete(c.pending, id)
+}
+
+// deliverReply hands msg to the call waiting on it. It returns false if no call is waiting.
+func (c *ctx) deliverReply(msg *Message) bool {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	replyc, ok := c.pending[msg.ReplyTo]
+	if !ok {
+		return false
+	}
+
+	delete(c.pending, msg.ReplyTo)
+	replyc <- msg
+	return true
+}
+
+// closePending wakes up all the calls waiting on a reply when the connection closes.
+func (c *ctx) closePending() {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for id, replyc := range c.pending {
+		close(replyc)
+		delete(c.pending, id)
+	}
+}
@@ -0,0 +1,200 @@
+package hero
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallMatchesConcurrentReplies(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewHero("")
+	server.Action("echo", func(c Context) error {
+		var body string
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		return c.JSON("echo", body)
+	})
+	go newConnection(ctx, server, serverConn).handleConnection()
+
+	client := newConnection(ctx, NewHero(""), clientConn)
+	go client.handleConnection()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			callCtx, callCancel := context.WithTimeout(ctx, 3*time.Second)
+			defer callCancel()
+
+			var reply string
+			req := fmt.Sprintf("request-%d", i)
+			assert.Nil(t, client.ctx.Call(callCtx, "echo", req, &reply))
+			assert.Equal(t, req, reply)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCallReturnsErrorReply(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go newConnection(ctx, NewHero(""), serverConn).handleConnection()
+	client := newConnection(ctx, NewHero(""), clientConn)
+	go client.handleConnection()
+
+	callCtx, callCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer callCancel()
+	err := client.ctx.Call(callCtx, "missing", "", nil)
+	assert.EqualError(t, err, "no such action: missing")
+}
+
+func TestActionTimeoutCancelsReadMsg(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handlerErr := make(chan error, 1)
+	server := NewHero("")
+	server.Action("wait", func(c Context) error {
+		var body string
+		err := c.ReadMsg(&body)
+		handlerErr <- err
+		return err
+	}, WithTimeout(100*time.Millisecond))
+	go newConnection(ctx, server, serverConn).handleConnection()
+
+	client := newCtx(NewHero(""), clientConn)
+	assert.Nil(t, client.WriteMsg("wait", nil))
+
+	select {
+	case err := <-handlerErr:
+		assert.Equal(t, context.DeadlineExceeded, err)
+	case <-time.After(3 * time.Second):
+		t.Fatalf("ReadMsg didn't return after the action timeout")
+	}
+}
+
+func TestActionTimeoutPartWayThroughFrameClosesConnection(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewHero("")
+	server.Action("wait", func(c Context) error {
+		var body string
+		return c.ReadMsg(&body)
+	}, WithTimeout(100*time.Millisecond))
+	go newConnection(ctx, server, serverConn).handleConnection()
+
+	client := newCtx(NewHero(""), clientConn)
+	assert.Nil(t, client.WriteMsg("wait", nil))
+
+	// A header for a frame whose body never comes. The server can't find the next
+	// message after giving up on this one, so it has to hang up.
+	_, err := clientConn.Write([]byte{100, 0, 0, 0})
+	assert.Nil(t, err)
+
+	_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = clientConn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadMsgLeavesConnectionOpenOnceHandlerReturns(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewHero("")
+	server.Action("read", func(c Context) error {
+		var body string
+		if err := c.ReadMsg(&body); err != nil {
+			return err
+		}
+
+		// Return straight away, while ReadMsg's watch on the context may still be going
+		if body != "last" {
+			return nil
+		}
+		return c.JSON("read", body)
+	})
+	go newConnection(ctx, server, serverConn).handleConnection()
+
+	// The handler's context is cancelled as it returns, which mustn't be taken as
+	// ReadMsg being interrupted
+	client := newCtx(NewHero(""), clientConn)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, client.WriteMsg("read", nil))
+		if !assert.Nil(t, client.WriteMsg("body", "not yet")) {
+			return
+		}
+	}
+
+	assert.Nil(t, client.WriteMsg("read", nil))
+	assert.Nil(t, client.WriteMsg("body", "last"))
+	msg, err := client.readMsg()
+	if assert.Nil(t, err) {
+		assert.Equal(t, "read", msg.Action)
+	}
+}
+
+func TestKeptContextFollowsTheConnection(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var kept Context
+	server := NewHero("")
+	server.Action("keep", func(c Context) error {
+		kept = c
+		return fmt.Errorf("kept")
+	})
+
+	// Error hooks run after the handler has returned
+	returned := make(chan struct{}, 1)
+	server.OnError(func(c Context, err error) {
+		returned <- struct{}{}
+	})
+	go newConnection(ctx, server, serverConn).handleConnection()
+
+	client := newCtx(NewHero(""), clientConn)
+	assert.Nil(t, client.WriteMsg("keep", nil))
+	<-returned
+
+	// The message's context is done, but the kept Context is still good to use
+	assert.Nil(t, kept.Context().Err())
+
+	cancel()
+	assert.Equal(t, context.Canceled, kept.Context().Err())
+}
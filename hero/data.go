@@ -0,0 +1,91 @@
+package hero
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// frameTypeData marks a frame that carries an action name and a raw payload. Data
+// frames skip the codec entirely, which makes them the cheap way to move file data.
+// The layout is the frame type, one byte for the length of the action name, the
+// action name and then the payload.
+const frameTypeData byte = 0x02
+
+// MaxDataFrameSize is the largest payload sent in a single data frame. Larger writes
+// are split across several frames.
+const MaxDataFrameSize = 1024 * 1024
+
+func encodeDataFrame(action string, data []byte) ([]byte, error) {
+	if len(action) > 255 {
+		return nil, fmt.Errorf("action name too long for a data frame: %s", action)
+	}
+
+	b := make([]byte, 0, 2+len(action)+len(data))
+	b = append(b, frameTypeData, byte(len(action)))
+	b = append(b, action...)
+	return append(b, data...), nil
+}
+
+func decodeDataFrame(b []byte) (*Message, error) {
+	if len(b) < 2 || len(b) < 2+int(b[1]) {
+		return &Message{}, fmt.Errorf("short data frame")
+	}
+
+	actionEnd := 2 + int(b[1])
+	return &Message{Action: string(b[2:actionEnd]), data: b[actionEnd:], isData: true}, nil
+}
+
+// dataWriter sends everything written to it as data frames for action.
+type dataWriter struct {
+	c      *ctx
+	action string
+}
+
+func (w *dataWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > MaxDataFrameSize {
+			n = MaxDataFrameSize
+		}
+
+		if err := w.c.WriteData(w.action, p[:n]); err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// DataReader returns a reader for the payload of the data frame being handled. For
+// messages that aren't data frames the reader is empty.
+func (c *ctx) DataReader() io.Reader {
+	if c.msg == nil {
+		return bytes.NewReader(nil)
+	}
+
+	return bytes.NewReader(c.msg.data)
+}
+
+// DataWriter returns a writer that sends everything written to it as data frames
+// for action, so for example a file can be sent with io.Copy.
+func (c *ctx) DataWriter(action string) io.Writer {
+	return &dataWriter{c: c, action: action}
+}
+
+// WriteData sends data as a single data frame for action.
+func (c *ctx) WriteData(action string, data []byte) error {
+	frame, err := encodeDataFrame(action, data)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = writeFrameToConn(c.conn, frame, c.activeCipher())
+	return err
+}
@@ -0,0 +1,59 @@
+package hero
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataFramesAreEncryptedAndStreamed(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := bytes.Repeat([]byte{7}, 32)
+	received := &bytes.Buffer{}
+	done := make(chan struct{})
+
+	server := NewHero("")
+	server.Action("file-chunk", func(c Context) error {
+		_, err := io.Copy(received, c.DataReader())
+		return err
+	})
+	server.Action("file-done", func(c Context) error {
+		close(done)
+		return nil
+	})
+	serverConnection := newConnection(ctx, server, serverConn)
+	serverConnection.ctx.SetEncryptionKey(key)
+	assert.Nil(t, serverConnection.ctx.TurnEncryptionOn())
+	go serverConnection.handleConnection()
+
+	client := newCtx(NewHero(""), clientConn)
+	client.isClient = true
+	client.SetEncryptionKey(key)
+	assert.Nil(t, client.TurnEncryptionOn())
+
+	// Big enough to be split over several frames
+	file := bytes.Repeat([]byte("0123456789"), MaxDataFrameSize/4)
+	n, err := io.Copy(client.DataWriter("file-chunk"), bytes.NewReader(file))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(file)), n)
+	assert.Nil(t, client.WriteMsg("file-done", nil))
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatalf("Timed out waiting for file-done")
+	}
+
+	assert.Equal(t, file, received.Bytes())
+}
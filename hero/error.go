@@ -0,0 +1,88 @@
+package hero
+
+import (
+	"errors"
+)
+
+// Error codes used by hero itself. Applications define their own codes for the errors
+// their handlers return.
+const (
+	// ErrCodeInternal is sent for errors that aren't a hero.Error.
+	ErrCodeInternal = "internal"
+
+	// ErrCodeNoSuchAction is sent when a message names an action that isn't registered.
+	ErrCodeNoSuchAction = "no_such_action"
+
+	// ErrCodeNoSuchConnection is returned by Hero.Send when there isn't a connection
+	// with the given ID.
+	ErrCodeNoSuchConnection = "no_such_connection"
+)
+
+// Error is an error that can be sent to the other side of a connection and turned back
+// into an Error there. The Code is stable and is what errors.Is compares, while the
+// Message is meant for people and may change.
+type Error struct {
+	Code    string
+	Message string
+	Details map[string]string
+}
+
+// NewError creates an Error with the given code and message.
+func NewError(code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is an Error with the same code, so errors.Is matches
+// error replies against the sentinel errors handlers return.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok || t.Code == "" {
+		return false
+	}
+
+	return t.Code == e.Code
+}
+
+// WithDetail returns a copy of the error with key set to value in its details.
+func (e *Error) WithDetail(key, value string) *Error {
+	details := make(map[string]string, len(e.Details)+1)
+	for k, v := range e.Details {
+		details[k] = v
+	}
+	details[key] = value
+
+	return &Error{Code: e.Code, Message: e.Message, Details: details}
+}
+
+// toError turns err into an Error for sending to the other side. Errors that aren't
+// an Error, and don't wrap one, are sent with ErrCodeInternal.
+func toError(err error) *Error {
+	var herr *Error
+	if errors.As(err, &herr) {
+		return herr
+	}
+
+	return NewError(ErrCodeInternal, err.Error())
+}
+
+// setError fills in the error fields of the message from err.
+func (m *Message) setError(err error) {
+	herr := toError(err)
+	m.Error = herr.Message
+	m.ErrorCode = herr.Code
+	m.ErrorDetails = herr.Details
+}
+
+// Err returns the error carried by the message as an Error, or nil if there isn't one.
+// Messages from peers that don't send codes come back as an Error with an empty Code.
+func (m *Message) Err() error {
+	if m.Error == "" && m.ErrorCode == "" {
+		return nil
+	}
+
+	return &Error{Code: m.ErrorCode, Message: m.Error, Details: m.ErrorDetails}
+}
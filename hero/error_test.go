@@ -0,0 +1,93 @@
+package hero
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errSlotsFull = NewError("slots_full", "slots full")
+
+func TestErrorRepliesKeepTheirCode(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewHero("")
+	server.Action("typed", func(c Context) error {
+		return fmt.Errorf("joining: %w", errSlotsFull.WithDetail("relay", "abc"))
+	})
+	server.Action("plain", func(c Context) error {
+		return fmt.Errorf("something broke")
+	})
+	go newConnection(ctx, server, serverConn).handleConnection()
+
+	client := newConnection(ctx, NewHero(""), clientConn)
+	go client.handleConnection()
+
+	callCtx, callCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer callCancel()
+
+	err := client.ctx.Call(callCtx, "typed", "", nil)
+	assert.True(t, errors.Is(err, errSlotsFull))
+	var herr *Error
+	assert.True(t, errors.As(err, &herr))
+	assert.Equal(t, "slots full", herr.Message)
+	assert.Equal(t, map[string]string{"relay": "abc"}, herr.Details)
+
+	err = client.ctx.Call(callCtx, "plain", "", nil)
+	assert.False(t, errors.Is(err, errSlotsFull))
+	assert.True(t, errors.Is(err, NewError(ErrCodeInternal, "")))
+	assert.EqualError(t, err, "something broke")
+
+	err = client.ctx.Call(callCtx, "missing", "", nil)
+	assert.True(t, errors.Is(err, NewError(ErrCodeNoSuchAction, "")))
+}
+
+func TestUnsolicitedErrorRepliesGoToErrorHooks(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewHero("")
+	server.Action("join", func(c Context) error {
+		return errSlotsFull
+	})
+	go newConnection(ctx, server, serverConn).handleConnection()
+
+	errs := make(chan error, 2)
+	clientHero := NewHero("")
+	clientHero.OnError(func(c Context, err error) {
+		errs <- err
+	})
+	client := newConnection(ctx, clientHero, clientConn)
+	go client.handleConnection()
+
+	// Sent without Call, so the error reply isn't waited on by anything
+	assert.Nil(t, client.ctx.WriteMsg("join", nil))
+
+	select {
+	case err := <-errs:
+		assert.True(t, errors.Is(err, errSlotsFull))
+	case <-time.After(3 * time.Second):
+		t.Fatal("error reply didn't reach the error hooks")
+	}
+
+	// The client doesn't answer the error with one of its own
+	select {
+	case err := <-errs:
+		t.Fatalf("unexpected error: %s", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,100 @@
+package hero
+
+import (
+	"time"
+
+	"github.com/apex/log"
+)
+
+// DefaultIdleTimeout is how long a connection can go without receiving anything
+// before it is closed.
+const DefaultIdleTimeout = 3 * time.Hour
+
+// The heartbeat actions are handled by hero itself and never reach the registered
+// actions or a handler's ReadMsg.
+const (
+	pingAction = "hero.ping"
+	pongAction = "hero.pong"
+)
+
+// heartbeat pings the peer every interval while the connection is idle, so the peer's
+// idle timeout doesn't expire and so ours is reset by the pong. It stops when the
+// connection closes. Nothing is sent while an action is running, since the action may
+// hijack the connection and hand it to something that doesn't speak hero.
+func (c *connection) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.connContext.Done():
+			return
+		case <-ticker.C:
+			if c.isBusy() {
+				continue
+			}
+
+			if err := c.ctx.ping(); err != nil {
+				log.Debugf("Heartbeat failed, closing connection: %s", err)
+				_ = c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *connection) isBusy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.busy
+}
+
+// ping sends a heartbeat unless the connection has been hijacked.
+func (c *ctx) ping() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.hijacked {
+		return nil
+	}
+
+	_, err := c.writeMessageLocked(&Message{Action: pingAction}, nil)
+	return err
+}
+
+// pong answers a ping unless the connection has been hijacked. Whatever took over a
+// hijacked connection owns what is written to it, even while hero is still reading.
+func (c *ctx) pong() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.hijacked {
+		return nil
+	}
+
+	_, err := c.writeMessageLocked(&Message{Action: pongAction}, nil)
+	return err
+}
+
+// handleHeartbeat answers pings and swallows pongs. It returns true if msg was a
+// heartbeat. Receiving either already reset the read deadline.
+func (c *ctx) handleHeartbeat(msg *Message) bool {
+	switch msg.Action {
+	case pingAction:
+		if err := c.pong(); err != nil {
+			log.Debugf("Unable to answer ping: %s", err)
+		}
+		return true
+	case pongAction:
+		return true
+	default:
+		return false
+	}
+}
+
+// setReadDeadline gives the next read the hero's idle timeout to complete.
+func (c *ctx) setReadDeadline() {
+	if timeout := c.hero.IdleTimeout; timeout > 0 {
+		_ = c.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
@@ -0,0 +1,103 @@
+package hero
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gtarcea/ft/internal/network"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeatsKeepIdleConnectionsOpen(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	server := NewHero("")
+	server.IdleTimeout = 200 * time.Millisecond
+	disconnected := make(chan struct{})
+	server.OnDisconnect(func(c Context) {
+		close(disconnected)
+	})
+	s := newConnection(context.Background(), server, serverConn)
+	assert.Nil(t, server.trackConnection(s))
+	go s.serve()
+
+	client := NewHero("")
+	client.HeartbeatInterval = 50 * time.Millisecond
+	clientCtx, stopClient := context.WithCancel(context.Background())
+	c := newConnection(clientCtx, client, clientConn)
+	c.ctx.isClient = true
+	go c.handleConnection()
+
+	// Several idle timeouts pass without the server giving up on the client
+	select {
+	case <-disconnected:
+		t.Fatalf("Server closed a connection that was sending heartbeats")
+	case <-time.After(time.Second):
+	}
+
+	// Once the client goes quiet the server times it out and runs the disconnect hooks
+	stopClient()
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Server didn't close the connection after it stopped sending heartbeats")
+	}
+}
+
+func TestHeartbeatsAreNotDispatchedAsActions(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	server := NewHero("")
+	server.HeartbeatInterval = 10 * time.Millisecond
+	server.IdleTimeout = 50 * time.Millisecond
+	serverErrs := make(chan error, 10)
+	server.OnError(func(c Context, err error) {
+		serverErrs <- err
+	})
+	go newConnection(context.Background(), server, serverConn).handleConnection()
+
+	// The client has no heartbeat of its own, so only its pongs keep the server's
+	// idle timeout from expiring. A ping dispatched as an action would be an error.
+	client := NewHero("")
+	clientErrs := make(chan error, 10)
+	client.OnError(func(c Context, err error) {
+		clientErrs <- err
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newConnection(ctx, client, clientConn)
+	c.ctx.isClient = true
+	go c.handleConnection()
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, serverErrs)
+	assert.Empty(t, clientErrs)
+}
+
+func TestHijackedConnectionsDontAnswerPings(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	c := newConnection(context.Background(), NewHero(""), clientConn)
+	go c.handleConnection()
+
+	// Taken over while hero is still reading, as a client does before its last message
+	c.ctx.Hijack()
+
+	s := newCtx(NewHero(""), serverConn)
+	_, err := s.writeMessage(&Message{Action: pingAction}, nil)
+	assert.Nil(t, err)
+
+	// The pong would land in the middle of whatever the new owner writes
+	_ = serverConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = network.Read(serverConn)
+	if netErr, ok := err.(net.Error); assert.True(t, ok) {
+		assert.True(t, netErr.Timeout())
+	}
+}
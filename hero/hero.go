@@ -2,111 +2,554 @@ package hero
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/apex/log"
+	"github.com/gtarcea/ft/internal/network"
 )
 
-type EncrypterFunc func(key []byte, buf []byte) ([]byte, error)
-type DecrypterFunc func(key []byte, buf []byte) ([]byte, error)
+// DefaultDrainTimeout is how long Shutdown waits for in-flight actions to finish
+// before closing the remaining connections.
+const DefaultDrainTimeout = 10 * time.Second
 
 type Hero struct {
-	Address       string
-	listener      net.Listener
-	context       context.Context
-	actions       map[string]*action
-	middleware    []HandlerFunc
-	EncrypterFunc EncrypterFunc
-	DecrypterFunc DecrypterFunc
+	// Network is the network Start listens on and Connect dials, such as "tcp" or
+	// "unix". It defaults to "tcp". For "unix" the Address is the socket's path.
+	Network    string
+	Address    string
+	listener   net.Listener
+	context    context.Context
+	actions    map[string]*action
+	middleware []MiddlewareFunc
+
+	// CipherSuites are the suites a connection can pick with SetCipherSuite, in order of
+	// preference. Connections that don't pick one are encrypted with AES256GCM.
+	CipherSuites []CipherSuite
+
+	// RekeyAfterBytes and RekeyAfterFrames are how much a connection sends with one key
+	// before rotating to the next. Zero means no limit. They default to
+	// DefaultRekeyAfterBytes and DefaultRekeyAfterFrames.
+	RekeyAfterBytes  int64
+	RekeyAfterFrames int64
+
+	// MaxFrameSize is the largest frame a connection accepts. A peer that sends a
+	// larger frame is disconnected before anything is allocated for it. It defaults to
+	// network.DefaultMaxFrameSize.
+	MaxFrameSize int
+
+	// TLSConfig turns on TLS. A server uses it for the connections it accepts, and
+	// requires client certificates if its ClientAuth says so. A client uses it when
+	// dialing in Connect.
+	TLSConfig *tls.Config
+
+	// DialFunc, when set, is used by Connect to make the connection instead of dialing
+	// Network. The connection it returns is used as is, TLSConfig isn't applied to it.
+	// It lets a client connect over something other than a socket, such as herotest's
+	// in-memory Listener.
+	DialFunc func(address string) (net.Conn, error)
+
+	// Codecs are the codecs hero can use for messages, in order of preference. A client
+	// offers them when it connects and a server picks the first offered codec it also
+	// has. Connections stay on JSON when nothing else is agreed on.
+	Codecs []Codec
+
+	// store holds values shared by all connections.
+	store sync.Map
+
+	connectHooks    []HandlerFunc
+	disconnectHooks []DisconnectFunc
+	errorHooks      []ErrorFunc
+
+	// HeartbeatInterval is how often an idle connection pings its peer. The default of
+	// zero turns heartbeats off, which is needed when the peer doesn't use hero.
+	HeartbeatInterval time.Duration
+
+	// IdleTimeout closes a connection that hasn't received anything, including a
+	// heartbeat, for this long. Set it to a few HeartbeatIntervals to detect dead peers.
+	// Zero means no timeout.
+	IdleTimeout time.Duration
+
+	// DrainTimeout is how long Shutdown gives in-flight actions to finish before
+	// force closing their connections.
+	DrainTimeout time.Duration
+
+	// connections tracks the live connections by their ID. connectionsWG is used to
+	// wait for their goroutines to exit on shutdown. lastConnectionID is the last ID
+	// handed out and is accessed atomically.
+	connections      map[string]*connection
+	lastConnectionID uint64
+	connectionsMu    sync.Mutex
+	connectionsWG    sync.WaitGroup
+
+	// quit is closed when shutdown starts and shutdownDone when it has finished.
+	quit         chan struct{}
+	shutdownDone chan struct{}
+	shutdownOnce sync.Once
 }
 
 type action struct {
-	name    string
-	handler HandlerFunc
+	name       string
+	handler    HandlerFunc
+	timeout    time.Duration
+	group      *Group
+	middleware []MiddlewareFunc
+}
+
+// ActionOption configures an action when it is added with Hero.Action.
+type ActionOption func(*action)
+
+// WithTimeout limits how long the action's handler has to run. The handler's
+// Context().Done() is closed once the timeout passes.
+func WithTimeout(timeout time.Duration) ActionOption {
+	return func(a *action) {
+		a.timeout = timeout
+	}
 }
 
 type HandlerFunc func(Context) error
 
+// DisconnectFunc is called when a connection closes.
+type DisconnectFunc func(Context)
+
+// ErrorFunc is called when an action returns an error or a connection fails.
+type ErrorFunc func(Context, error)
+
 func NewHero(address string) *Hero {
 	return &Hero{
-		Address:       address,
-		actions:       make(map[string]*action),
-		EncrypterFunc: defaultEncrypterFunc,
-		DecrypterFunc: defaultDecrypterFunc,
+		Address:          address,
+		actions:          make(map[string]*action),
+		CipherSuites:     []CipherSuite{AES256GCM, ChaCha20Poly1305},
+		RekeyAfterBytes:  DefaultRekeyAfterBytes,
+		RekeyAfterFrames: DefaultRekeyAfterFrames,
+		MaxFrameSize:     network.DefaultMaxFrameSize,
+		Codecs:           []Codec{JSONCodec},
+		DrainTimeout:     DefaultDrainTimeout,
+		IdleTimeout:      DefaultIdleTimeout,
+		connections:      make(map[string]*connection),
+		quit:             make(chan struct{}),
+		shutdownDone:     make(chan struct{}),
 	}
 }
 
-func defaultEncrypterFunc(key []byte, buf []byte) ([]byte, error) {
-	return nil, fmt.Errorf("encrypter not implemented")
-}
+// Start listens on the hero Address and handles connections until ctx is cancelled
+// or Shutdown is called. When shutting down Start returns once all the connections
+// have been closed.
+func (h *Hero) Start(ctx context.Context) error {
+	listener, err := net.Listen(h.network(), h.Address)
+	if err != nil {
+		return err
+	}
 
-func defaultDecrypterFunc(key []byte, buf []byte) ([]byte, error) {
-	return nil, fmt.Errorf("decrypter not implemented")
+	return h.Serve(ctx, listener)
 }
 
-func (h *Hero) Start(ctx context.Context) error {
-	var err error
+// Serve handles the connections accepted on listener until ctx is cancelled or Shutdown
+// is called. Any listener works, so hero can be served over a Unix socket, a socket
+// handed over by systemd or an in memory listener. Serve takes ownership of the listener
+// and closes it when shutting down. It returns once all the connections have been closed.
+func (h *Hero) Serve(ctx context.Context, listener net.Listener) error {
 	h.context = ctx
-	if h.listener, err = net.Listen("tcp", h.Address); err != nil {
+	if err := h.setListener(listener); err != nil {
 		return err
 	}
-	h.acceptLoop()
-	return nil
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = h.Shutdown()
+		case <-h.quit:
+		}
+	}()
+
+	err := h.acceptLoop(listener)
+
+	if h.isShuttingDown() {
+		<-h.shutdownDone
+		return nil
+	}
+
+	return err
 }
 
-func (h *Hero) Connect(ctx context.Context, address string, startState string) error {
+// Connect dials address and uses hero as a client. It runs the startAction against the
+// new connection and then dispatches messages sent by the server to the registered
+// actions, the same way a server handles its connections. Connect blocks until the
+// connection is closed or ctx is cancelled.
+func (h *Hero) Connect(ctx context.Context, address string, startAction string) error {
 	var (
 		err  error
 		conn net.Conn
 	)
-	if conn, err = net.DialTimeout("tcp", address, 3*time.Second); err != nil {
+
+	if _, ok := h.actions[startAction]; !ok {
+		return NewError(ErrCodeNoSuchAction, fmt.Sprintf("no such action: %s", startAction))
+	}
+
+	if conn, err = h.dial(address); err != nil {
 		return err
 	}
 
-	action := h.actions[startState]
-	c := newConnection(h, conn)
-	_ = action
-	_ = c
+	c := newConnection(ctx, h, conn)
+	c.ctx.isClient = true
+	if err := h.trackConnection(c); err != nil {
+		_ = conn.Close()
+		return err
+	}
 
-	// Run start action and then drop into c.handleConnection
+	// The read loop only checks for cancellation between messages, so close the
+	// connection to unblock it when ctx is cancelled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	if !c.startAction() {
+		h.untrackConnection(c)
+		_ = conn.Close()
+		return fmt.Errorf("hero is shutting down")
+	}
+
+	if err := h.runConnectHooks(c.ctx); err != nil {
+		c.finishAction()
+		c.ctx.cancel()
+		h.untrackConnection(c)
+		_ = conn.Close()
+		return err
+	}
+
+	err = c.runMsgAction(&Message{Action: startAction})
+	c.finishAction()
+	if err != nil {
+		c.finish()
+		return err
+	}
+
+	c.handleConnection()
 	return nil
 }
 
-func (h *Hero) acceptLoop() {
-	tcpListener := h.listener.(*net.TCPListener)
-AcceptLoop:
+func (h *Hero) network() string {
+	if h.Network == "" {
+		return "tcp"
+	}
+
+	return h.Network
+}
+
+// dial connects to address with DialFunc, or over Network using TLS if TLSConfig is
+// set.
+func (h *Hero) dial(address string) (net.Conn, error) {
+	if h.DialFunc != nil {
+		return h.DialFunc(address)
+	}
+
+	dialer := &net.Dialer{Timeout: 3 * time.Second}
+	if h.TLSConfig != nil {
+		return tls.DialWithDialer(dialer, h.network(), address, h.TLSConfig)
+	}
+
+	return dialer.Dial(h.network(), address)
+}
+
+// acceptLoop accepts connections until the listener is closed by Shutdown, or fails.
+// Temporary errors, such as running out of file descriptors, are retried with a backoff.
+func (h *Hero) acceptLoop(listener net.Listener) error {
+	var backoff time.Duration
 	for {
-		select {
-		case <-h.context.Done():
-			log.Infof("Shutting down...")
-			_ = tcpListener.Close()
-			return
-		default:
-			_ = tcpListener.SetDeadline(time.Now().Add(2 * time.Second))
-			conn, err := tcpListener.Accept()
-			if err != nil {
-				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-					continue AcceptLoop
-				}
-				return
+		conn, err := listener.Accept()
+		if err != nil {
+			if h.isShuttingDown() {
+				log.Infof("Shutting down...")
+				return nil
 			}
-			c := newConnection(h, conn)
-			go c.handleConnection()
+
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				backoff = nextAcceptBackoff(backoff)
+				log.Debugf("Accept failed, retrying in %s: %s", backoff, err)
+				time.Sleep(backoff)
+				continue
+			}
+
+			return err
+		}
+		backoff = 0
+
+		if h.TLSConfig != nil {
+			// The handshake runs on the first read, in the connection's goroutine
+			conn = tls.Server(conn, h.TLSConfig)
 		}
+		c := newConnection(h.context, h, conn)
+		if err := h.trackConnection(c); err != nil {
+			_ = conn.Close()
+			continue
+		}
+		go c.serve()
 	}
 }
 
+func nextAcceptBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return 5 * time.Millisecond
+	}
+
+	if backoff *= 2; backoff > time.Second {
+		return time.Second
+	}
+
+	return backoff
+}
+
+// Shutdown stops hero from accepting new connections and closes connections that
+// are waiting on a message. Connections that are running an action are given
+// DrainTimeout to finish before they are force closed. Shutdown returns once
+// every connection goroutine has exited.
 func (h *Hero) Shutdown() error {
+	first := false
+	h.shutdownOnce.Do(func() {
+		first = true
+		close(h.quit)
+	})
+
+	if !first {
+		// Shutdown is already in progress, wait for it to finish
+		<-h.shutdownDone
+		return nil
+	}
+
+	defer close(h.shutdownDone)
+
+	var err error
+	if listener := h.getListener(); listener != nil {
+		err = listener.Close()
+	}
+
+	for _, c := range h.liveConnections() {
+		// Let running actions know we are shutting down
+		c.ctx.cancel()
+		c.closeIfIdle()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		h.connectionsWG.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return err
+	case <-time.After(h.DrainTimeout):
+	}
+
+	log.Infof("Drain timeout reached, closing remaining connections")
+	for _, c := range h.liveConnections() {
+		_ = c.conn.Close()
+	}
+
+	<-drained
+	return err
+}
+
+func (h *Hero) isShuttingDown() bool {
+	select {
+	case <-h.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// setListener sets the listener hero accepts connections on. The listener is closed
+// and an error returned if hero is already shutting down.
+func (h *Hero) setListener(listener net.Listener) error {
+	h.connectionsMu.Lock()
+	defer h.connectionsMu.Unlock()
+
+	if h.isShuttingDown() {
+		_ = listener.Close()
+		return fmt.Errorf("hero is shutting down")
+	}
+
+	h.listener = listener
 	return nil
 }
 
+func (h *Hero) getListener() net.Listener {
+	h.connectionsMu.Lock()
+	defer h.connectionsMu.Unlock()
+	return h.listener
+}
+
+// trackConnection adds c to the live connections. It fails if hero is shutting down.
+func (h *Hero) trackConnection(c *connection) error {
+	h.connectionsMu.Lock()
+	defer h.connectionsMu.Unlock()
+
+	if h.isShuttingDown() {
+		return fmt.Errorf("hero is shutting down")
+	}
+
+	h.connections[c.ctx.id] = c
+	h.connectionsWG.Add(1)
+	return nil
+}
+
+// untrackConnection removes c from the live connections. It is safe to call for a
+// connection that was never tracked.
+func (h *Hero) untrackConnection(c *connection) {
+	h.connectionsMu.Lock()
+	defer h.connectionsMu.Unlock()
+
+	if tracked, ok := h.connections[c.ctx.id]; ok && tracked == c {
+		delete(h.connections, c.ctx.id)
+		h.connectionsWG.Done()
+	}
+}
+
+func (h *Hero) liveConnections() []*connection {
+	h.connectionsMu.Lock()
+	defer h.connectionsMu.Unlock()
+
+	connections := make([]*connection, 0, len(h.connections))
+	for _, c := range h.connections {
+		connections = append(connections, c)
+	}
+
+	return connections
+}
+
+// Connections returns the contexts of the live connections, including those still
+// running their connect handlers and those that have been hijacked but whose handler
+// hasn't returned yet.
+func (h *Hero) Connections() []Context {
+	live := h.liveConnections()
+	contexts := make([]Context, 0, len(live))
+	for _, c := range live {
+		contexts = append(contexts, c.ctx)
+	}
+
+	return contexts
+}
+
+// AddMiddleware adds a handler that runs before every action. If it returns an error
+// the action isn't run. It is the same as Use(WrapMiddleware(handler)).
 func (h *Hero) AddMiddleware(handler HandlerFunc) {
-	h.middleware = append(h.middleware, handler)
+	h.Use(WrapMiddleware(handler))
+}
+
+// Use adds middleware that wraps every action. Middleware runs in the order it was added,
+// with the first middleware being the outermost.
+func (h *Hero) Use(middleware ...MiddlewareFunc) {
+	h.middleware = append(h.middleware, middleware...)
 }
 
-func (h *Hero) Action(name string, handler HandlerFunc) {
-	action := &action{name: name, handler: handler}
+// Group creates a group of actions named prefix/name that share the given middleware.
+func (h *Hero) Group(prefix string, middleware ...MiddlewareFunc) *Group {
+	return &Group{hero: h, prefix: prefix, middleware: middleware}
+}
+
+func (h *Hero) Action(name string, handler HandlerFunc, opts ...ActionOption) {
+	h.addAction(name, handler, nil, opts...)
+}
+
+func (h *Hero) addAction(name string, handler HandlerFunc, group *Group, opts ...ActionOption) {
+	action := &action{name: name, handler: handler, group: group}
+	for _, opt := range opts {
+		opt(action)
+	}
 	h.actions[name] = action
 }
+
+// Get returns the value stored under key in the server wide store.
+func (h *Hero) Get(key string) interface{} {
+	val, _ := h.store.Load(key)
+	return val
+}
+
+// Set stores value under key in the server wide store. Values in this store are
+// seen by every connection, unlike Context.Set which stores per connection values.
+func (h *Hero) Set(key string, value interface{}) {
+	h.store.Store(key, value)
+}
+
+// Send sends a message for action to the connection with the given ID. It is how a
+// handler writes to a connection other than its own. The write is serialized with
+// the connection's other writes.
+func (h *Hero) Send(id string, action string, body interface{}) error {
+	h.connectionsMu.Lock()
+	c, ok := h.connections[id]
+	h.connectionsMu.Unlock()
+
+	if !ok {
+		return NewError(ErrCodeNoSuchConnection, fmt.Sprintf("no such connection: %s", id))
+	}
+
+	return c.ctx.push(action, body)
+}
+
+// Broadcast sends a message for action to every connection that filter returns true
+// for. A nil filter matches every connection. A failed send doesn't stop the others,
+// the first error is returned once all the sends have been tried.
+func (h *Hero) Broadcast(action string, body interface{}, filter func(Context) bool) error {
+	var firstErr error
+	for _, c := range h.liveConnections() {
+		if filter != nil && !filter(c.ctx) {
+			continue
+		}
+
+		if err := c.ctx.push(action, body); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// OnConnect adds a hook that is run when a connection is made, before any messages
+// are handled. If the hook returns an error the connection is closed.
+func (h *Hero) OnConnect(hook HandlerFunc) {
+	h.connectHooks = append(h.connectHooks, hook)
+}
+
+// OnDisconnect adds a hook that is run when a connection closes. It isn't run for
+// connections that have been hijacked.
+func (h *Hero) OnDisconnect(hook DisconnectFunc) {
+	h.disconnectHooks = append(h.disconnectHooks, hook)
+}
+
+// OnError adds a hook that is run when an action returns an error, or a connection
+// fails for any reason other than being closed.
+func (h *Hero) OnError(hook ErrorFunc) {
+	h.errorHooks = append(h.errorHooks, hook)
+}
+
+func (h *Hero) runConnectHooks(c Context) error {
+	for _, hook := range h.connectHooks {
+		if err := hook(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *Hero) runDisconnectHooks(c Context) {
+	for _, hook := range h.disconnectHooks {
+		hook(c)
+	}
+}
+
+func (h *Hero) runErrorHooks(c Context, err error) {
+	for _, hook := range h.errorHooks {
+		hook(c, err)
+	}
+}
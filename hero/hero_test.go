@@ -0,0 +1,328 @@
+package hero
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownWaitsForInFlightActions(t *testing.T) {
+	h := NewHero("")
+	actionStarted := make(chan struct{})
+	actionFinished := make(chan struct{})
+	h.Action("slow", func(c Context) error {
+		close(actionStarted)
+		time.Sleep(500 * time.Millisecond)
+		close(actionFinished)
+		return nil
+	})
+
+	address, served := serveOnLocalPort(t, h)
+
+	idleConn, err := net.DialTimeout("tcp", address, 2*time.Second)
+	assert.Nil(t, err)
+	defer idleConn.Close()
+
+	busyConn, err := net.DialTimeout("tcp", address, 2*time.Second)
+	assert.Nil(t, err)
+	defer busyConn.Close()
+
+	_, err = WriteMsgToConn(busyConn, "slow", nil, nil)
+	assert.Nil(t, err)
+	<-actionStarted
+
+	assert.Nil(t, h.Shutdown())
+
+	select {
+	case <-actionFinished:
+	default:
+		t.Fatalf("Shutdown returned before the in-flight action finished")
+	}
+
+	assert.Empty(t, h.liveConnections())
+	assert.Nil(t, <-served)
+}
+
+func TestShutdownForceClosesAfterDrainTimeout(t *testing.T) {
+	h := NewHero("")
+	h.DrainTimeout = 100 * time.Millisecond
+	actionStarted := make(chan struct{})
+	release := make(chan struct{})
+	h.Action("wait", func(c Context) error {
+		close(actionStarted)
+		// Ignores its context, so only the force close takes the connection away
+		<-release
+		return nil
+	})
+
+	address, _ := serveOnLocalPort(t, h)
+
+	conn, err := net.DialTimeout("tcp", address, 2*time.Second)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	_, err = WriteMsgToConn(conn, "wait", nil, nil)
+	assert.Nil(t, err)
+	<-actionStarted
+
+	shutdownStarted := time.Now()
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- h.Shutdown()
+	}()
+
+	// io.Copy returns nil once the server closes the connection
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.Copy(ioutil.Discard, conn)
+	assert.Nil(t, err, "Shutdown didn't force close the connection")
+	assert.True(t, time.Since(shutdownStarted) >= h.DrainTimeout, "connection closed before the drain timeout")
+
+	close(release)
+	select {
+	case err := <-shutdown:
+		assert.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Shutdown didn't return once the action finished")
+	}
+
+	assert.Empty(t, h.liveConnections())
+}
+
+func TestLifecycleHooksAndStores(t *testing.T) {
+	h := NewHero("")
+	h.OnConnect(func(c Context) error {
+		c.Set("user", "alice")
+		return nil
+	})
+
+	disconnected := make(chan string, 1)
+	h.OnDisconnect(func(c Context) {
+		disconnected <- c.Get("user").(string)
+	})
+
+	errs := make(chan error, 1)
+	h.OnError(func(c Context, err error) {
+		errs <- err
+	})
+
+	h.Action("whoami", func(c Context) error {
+		h.Set("last-user", c.Get("user"))
+		return fmt.Errorf("failed for %s", c.Get("user"))
+	})
+
+	serverConn, clientConn := net.Pipe()
+	c := newConnection(context.Background(), h, serverConn)
+	assert.Nil(t, h.trackConnection(c))
+	go c.serve()
+
+	_, err := WriteMsgToConn(clientConn, "whoami", nil, nil)
+	assert.Nil(t, err)
+	msg, err := ReadMsgFromConn(clientConn, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "failed for alice", msg.Error)
+	assert.Equal(t, "alice", h.Get("last-user"))
+	assert.EqualError(t, <-errs, "failed for alice")
+
+	_ = clientConn.Close()
+	select {
+	case user := <-disconnected:
+		assert.Equal(t, "alice", user)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Disconnect hook wasn't run")
+	}
+}
+
+func TestConnectHookRejectsConnection(t *testing.T) {
+	h := NewHero("")
+	h.OnConnect(func(c Context) error {
+		return fmt.Errorf("go away")
+	})
+
+	disconnectCalled := false
+	h.OnDisconnect(func(c Context) {
+		disconnectCalled = true
+	})
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	c := newConnection(context.Background(), h, serverConn)
+	assert.Nil(t, h.trackConnection(c))
+	c.serve()
+
+	_, err := clientConn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.False(t, disconnectCalled)
+	assert.Empty(t, h.liveConnections())
+}
+
+func TestServeOverUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hero-unix")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "control.sock")
+
+	h := NewHero("")
+	h.Action("status", func(c Context) error {
+		return c.JSON("status", "running")
+	})
+
+	// Listening before serving means the client can dial straight away
+	listener, err := net.Listen("unix", socket)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan error)
+	go func() {
+		started <- h.Serve(ctx, listener)
+	}()
+
+	connCtx, connCancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer connCancel()
+
+	var status string
+	client := NewHero(socket)
+	client.Network = "unix"
+	client.Action("start", func(c Context) error {
+		defer connCancel()
+		if err := c.JSON("status", nil); err != nil {
+			return err
+		}
+		return c.ReadMsg(&status)
+	})
+	assert.Nil(t, client.Connect(connCtx, socket, "start"))
+	assert.Equal(t, "running", status)
+
+	// Cancelling the context stops Serve without relying on accept deadlines
+	cancel()
+	select {
+	case err := <-started:
+		assert.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Serve didn't return after its context was cancelled")
+	}
+}
+
+func TestSendAndBroadcastReachOtherConnections(t *testing.T) {
+	h := NewHero("")
+	h.Action("join", func(c Context) error {
+		var name string
+		if err := c.Bind(&name); err != nil {
+			return err
+		}
+		c.Set("name", name)
+		h.Set(name, c.ID())
+		return c.JSON("joined", name)
+	})
+	h.Action("poke", func(c Context) error {
+		var name string
+		if err := c.Bind(&name); err != nil {
+			return err
+		}
+		id, _ := h.Get(name).(string)
+		return h.Send(id, "poked", "you were poked")
+	})
+	h.Action("shout", func(c Context) error {
+		return h.Broadcast("shouted", "hello everyone", func(other Context) bool {
+			return other.ID() != c.ID()
+		})
+	})
+
+	join := func(name string) net.Conn {
+		serverConn, clientConn := net.Pipe()
+		c := newConnection(context.Background(), h, serverConn)
+		assert.Nil(t, h.trackConnection(c))
+		go c.serve()
+
+		_, err := WriteMsgToConn(clientConn, "join", name, nil)
+		assert.Nil(t, err)
+		msg, err := ReadMsgFromConn(clientConn, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, "joined", msg.Action)
+		return clientConn
+	}
+
+	alice := join("alice")
+	defer alice.Close()
+	bob := join("bob")
+	defer bob.Close()
+	carol := join("carol")
+	defer carol.Close()
+
+	_, err := WriteMsgToConn(alice, "poke", "bob", nil)
+	assert.Nil(t, err)
+	msg, err := ReadMsgFromConn(bob, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "poked", msg.Action)
+
+	_, err = WriteMsgToConn(alice, "shout", nil, nil)
+	assert.Nil(t, err)
+	// Broadcast writes in no particular order, so read from everyone at once
+	var wg sync.WaitGroup
+	for _, conn := range []net.Conn{bob, carol} {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			msg, err := ReadMsgFromConn(conn, nil)
+			assert.Nil(t, err)
+			assert.Equal(t, "shouted", msg.Action)
+		}(conn)
+	}
+	wg.Wait()
+
+	err = h.Send("no-such-id", "poked", nil)
+	assert.True(t, errors.Is(err, NewError(ErrCodeNoSuchConnection, "")))
+}
+
+func TestConnectionsListsLiveConnections(t *testing.T) {
+	h := NewHero("")
+	var ids []string
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		serverConn, clientConn := net.Pipe()
+		c := newConnection(context.Background(), h, serverConn)
+		assert.Nil(t, h.trackConnection(c))
+		go c.serve()
+		ids = append(ids, c.ctx.ID())
+		clients = append(clients, clientConn)
+	}
+
+	var listed []string
+	for _, c := range h.Connections() {
+		listed = append(listed, c.ID())
+	}
+	assert.ElementsMatch(t, ids, listed)
+
+	// A closed connection is dropped once hero notices
+	clients[0].Close()
+	defer clients[1].Close()
+	assert.Eventually(t, func() bool {
+		connections := h.Connections()
+		return len(connections) == 1 && connections[0].ID() == ids[1]
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+// serveOnLocalPort serves h on a port picked by the OS, so tests don't fight over a
+// fixed port. It returns the address to dial and a channel that gets Serve's result.
+func serveOnLocalPort(t *testing.T, h *Hero) (string, <-chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- h.Serve(context.Background(), listener)
+	}()
+
+	return listener.Addr().String(), served
+}
@@ -0,0 +1,178 @@
+package herotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gtarcea/ft/hero"
+	"github.com/gtarcea/ft/internal/network"
+)
+
+// DefaultTimeout is how long a Client waits for a message before giving up.
+const DefaultTimeout = 5 * time.Second
+
+// Client talks to a hero server one message at a time, the way a test wants to. It
+// speaks JSON and leaves the codec negotiation alone, which hero servers always accept.
+type Client struct {
+	Conn net.Conn
+
+	// Timeout bounds each read, so a server that doesn't reply fails the test rather
+	// than hanging it.
+	Timeout time.Duration
+
+	// CipherSuites are the suites SetCipherSuite can pick from. When none is picked
+	// AES-256-GCM, hero's default, is used.
+	CipherSuites []hero.CipherSuite
+
+	encryptionKey []byte
+	encryptionOn  bool
+	cipherSuite   hero.CipherSuite
+	frameCipher   *hero.FrameCipher
+}
+
+func NewClient(conn net.Conn) *Client {
+	return &Client{Conn: conn, Timeout: DefaultTimeout, cipherSuite: hero.AES256GCM}
+}
+
+// Send sends a message for action with body encoded as JSON.
+func (c *Client) Send(action string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	frame, err := json.Marshal(hero.Message{Action: action, Body: b})
+	if err != nil {
+		return err
+	}
+
+	if c.encryptionOn {
+		if frame, err = c.frameCipher.Seal(frame); err != nil {
+			return err
+		}
+	}
+
+	_, err = network.Write(c.Conn, frame)
+	return err
+}
+
+// Read reads the next message.
+func (c *Client) Read() (*hero.Message, error) {
+	if c.Timeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+		defer func() {
+			_ = c.Conn.SetReadDeadline(time.Time{})
+		}()
+	}
+
+	frame, _, err := network.Read(c.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.encryptionOn {
+		if frame, err = c.frameCipher.Open(frame); err != nil {
+			return nil, err
+		}
+	}
+
+	var msg hero.Message
+	if err := json.Unmarshal(frame, &msg); err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// Expect reads the next message and decodes its body into body. An error reply is
+// returned as a *hero.Error. If action isn't empty the message has to be for action.
+func (c *Client) Expect(action string, body interface{}) error {
+	msg, err := c.Read()
+	if err != nil {
+		return err
+	}
+
+	if err := msg.Err(); err != nil {
+		return err
+	}
+
+	if action != "" && msg.Action != action {
+		return fmt.Errorf("expected message for action %s, got %s", action, msg.Action)
+	}
+
+	if body == nil {
+		return nil
+	}
+
+	return json.Unmarshal(msg.Body, body)
+}
+
+// Call sends req to action and decodes the reply into resp, whatever action the reply
+// is for. An error reply is returned as a *hero.Error.
+func (c *Client) Call(action string, req, resp interface{}) error {
+	if err := c.Send(action, req); err != nil {
+		return err
+	}
+
+	return c.Expect("", resp)
+}
+
+// SetCipherSuite picks the suite, from CipherSuites, that frames are encrypted with.
+// It has to be called before encryption is first turned on.
+func (c *Client) SetCipherSuite(name string) error {
+	if c.frameCipher != nil {
+		return fmt.Errorf("encryption has already been turned on")
+	}
+
+	for _, suite := range c.CipherSuites {
+		if suite.Name == name {
+			c.cipherSuite = suite
+			return nil
+		}
+	}
+
+	return fmt.Errorf("server picked a cipher suite that wasn't offered: %s", name)
+}
+
+// CipherSuite returns the name of the suite frames are encrypted with.
+func (c *Client) CipherSuite() string {
+	return c.cipherSuite.Name
+}
+
+func (c *Client) SetEncryptionKey(key []byte) {
+	c.encryptionKey = key
+	c.frameCipher = nil
+}
+
+func (c *Client) EncryptionKey() []byte {
+	return c.encryptionKey
+}
+
+// TurnEncryptionOn encrypts frames from here on with keys derived from the encryption
+// key, the same way the client end of a hero connection does.
+func (c *Client) TurnEncryptionOn() error {
+	if c.encryptionKey == nil {
+		return fmt.Errorf("no encryption key")
+	}
+
+	if c.frameCipher == nil {
+		fc, err := hero.NewFrameCipher(c.cipherSuite, c.encryptionKey, true)
+		if err != nil {
+			return err
+		}
+		c.frameCipher = fc
+	}
+
+	c.encryptionOn = true
+	return nil
+}
+
+func (c *Client) TurnEncryptionOff() {
+	c.encryptionOn = false
+}
+
+func (c *Client) Close() error {
+	return c.Conn.Close()
+}
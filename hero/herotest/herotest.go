@@ -0,0 +1,133 @@
+// Package herotest provides an in-memory harness for testing hero actions. Servers
+// run on a Listener whose connections are net.Pipe pairs, so tests need neither fixed
+// ports nor sleeps waiting for a server to come up. Clients of ft's hero services
+// can do the PAKE step those services start with using the paketest subpackage.
+package herotest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/gtarcea/ft/hero"
+)
+
+// ErrListenerClosed is returned by Accept and Dial once the Listener is closed.
+var ErrListenerClosed = errors.New("herotest: listener closed")
+
+// Listener is an in-memory net.Listener. Each Dial creates a net.Pipe and hands the
+// server side to Accept.
+type Listener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewListener() *Listener {
+	return &Listener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept waits for a Dial and returns the server side of its connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close stops the listener. Connections that were already accepted stay open.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial connects to the listener and returns the client side of the connection. A
+// hero client reaches the listener by setting Hero.DialFunc to call it, so code built
+// on Hero.Connect can be tested against an in-memory server too.
+func (l *Listener) Dial() (net.Conn, error) {
+	serverConn, clientConn := net.Pipe()
+	select {
+	case l.conns <- serverConn:
+		return clientConn, nil
+	case <-l.closed:
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+		return nil, ErrListenerClosed
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (pipeAddr) String() string {
+	return "herotest"
+}
+
+// ServeFunc serves connections from listener until ctx is cancelled. Hero.Serve is a
+// ServeFunc, as is the Serve method of servers built on hero.
+type ServeFunc func(ctx context.Context, listener net.Listener) error
+
+// Server runs a ServeFunc on an in-memory Listener.
+type Server struct {
+	Listener *Listener
+
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// NewServer starts serving h on an in-memory Listener.
+func NewServer(h *hero.Hero) *Server {
+	return StartServer(h.Serve)
+}
+
+// StartServer runs serve in the background on an in-memory Listener. There's no need
+// to wait for it to come up, Dial blocks until serve accepts the connection.
+func StartServer(serve ServeFunc) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		Listener: NewListener(),
+		cancel:   cancel,
+		done:     make(chan error, 1),
+	}
+
+	go func() {
+		s.done <- serve(ctx, s.Listener)
+	}()
+
+	return s
+}
+
+// Dial connects a new Client to the server.
+func (s *Server) Dial() (*Client, error) {
+	conn, err := s.Listener.Dial()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn), nil
+}
+
+// Close shuts down the server and waits for its ServeFunc to return, returning the
+// ServeFunc's error.
+func (s *Server) Close() error {
+	s.cancel()
+	err := <-s.done
+	_ = s.Listener.Close()
+	return err
+}
@@ -0,0 +1,85 @@
+package herotest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gtarcea/ft/hero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientCallsActions(t *testing.T) {
+	h := hero.NewHero("")
+	h.Action("echo", func(c hero.Context) error {
+		var body string
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		return c.JSON("echo", body)
+	})
+
+	s := NewServer(h)
+	client, err := s.Dial()
+	assert.Nil(t, err)
+	defer client.Close()
+
+	var reply string
+	assert.Nil(t, client.Call("echo", "hello", &reply))
+	assert.Equal(t, "hello", reply)
+
+	err = client.Call("missing", nil, nil)
+	assert.True(t, errors.Is(err, hero.NewError(hero.ErrCodeNoSuchAction, "")))
+
+	assert.Nil(t, client.Send("echo", "again"))
+	assert.NotNil(t, client.Expect("other", &reply))
+
+	assert.Nil(t, s.Close())
+	_, err = s.Dial()
+	assert.Equal(t, ErrListenerClosed, err)
+}
+
+func TestHeroConnectsThroughListener(t *testing.T) {
+	server := hero.NewHero("")
+	server.Action("echo", func(c hero.Context) error {
+		var body string
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		return c.JSON("echo", body)
+	})
+
+	s := NewServer(server)
+	defer s.Close()
+
+	reply := make(chan string, 1)
+	client := hero.NewHero("")
+	client.DialFunc = func(string) (net.Conn, error) {
+		return s.Listener.Dial()
+	}
+	client.Action("start", func(c hero.Context) error {
+		if err := c.JSON("echo", "hello"); err != nil {
+			return err
+		}
+
+		var body string
+		err := c.ReadMsg(&body)
+		reply <- body
+		return err
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = client.Connect(ctx, "herotest", "start")
+	}()
+
+	select {
+	case body := <-reply:
+		assert.Equal(t, "hello", body)
+	case <-time.After(DefaultTimeout):
+		t.Fatalf("Connect didn't reach the server")
+	}
+}
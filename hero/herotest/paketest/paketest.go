@@ -0,0 +1,40 @@
+// Package paketest does the PAKE step of ft's hero connections for herotest clients.
+// It is kept out of herotest so the harness itself stays protocol agnostic, and
+// shared so the relay's tests and ft's tests don't each need their own copy.
+package paketest
+
+import (
+	"github.com/gtarcea/ft/hero/herotest"
+	"github.com/gtarcea/ft/pkg/msgs"
+	"salsa.debian.org/vasudev/gospake2"
+)
+
+// Pake runs the SPAKE2 exchange with the server's pake action, offering the client's
+// CipherSuites, and turns encryption on with the key and the suite the server picked.
+func Pake(client *herotest.Client, password, appID string) error {
+	spake := gospake2.SPAKE2Symmetric(gospake2.NewPassword(password), gospake2.NewIdentityS(appID))
+
+	req := msgs.Pake{Body: spake.Start()}
+	for _, suite := range client.CipherSuites {
+		req.CipherSuites = append(req.CipherSuites, suite.Name)
+	}
+
+	var reply msgs.Pake
+	if err := client.Call("pake", req, &reply); err != nil {
+		return err
+	}
+
+	if reply.CipherSuite != "" {
+		if err := client.SetCipherSuite(reply.CipherSuite); err != nil {
+			return err
+		}
+	}
+
+	key, err := spake.Finish(reply.Body)
+	if err != nil {
+		return err
+	}
+
+	client.SetEncryptionKey(key)
+	return client.TurnEncryptionOn()
+}
@@ -0,0 +1,67 @@
+package paketest
+
+import (
+	"testing"
+
+	"github.com/gtarcea/ft/hero"
+	"github.com/gtarcea/ft/hero/herotest"
+	"github.com/gtarcea/ft/pkg/msgs"
+	"github.com/stretchr/testify/assert"
+	"salsa.debian.org/vasudev/gospake2"
+)
+
+func TestPakeTurnsEncryptionOn(t *testing.T) {
+	h := hero.NewHero("")
+	h.Action("pake", func(c hero.Context) error {
+		var req msgs.Pake
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		spake := gospake2.SPAKE2Symmetric(gospake2.NewPassword("password"), gospake2.NewIdentityS("app"))
+		reply := msgs.Pake{Body: spake.Start()}
+		key, err := spake.Finish(req.Body)
+		if err != nil {
+			return err
+		}
+
+		suite, ok := c.Hero().ChooseCipherSuite(req.CipherSuites)
+		if !ok {
+			return hero.NewError("no_common_cipher_suite", "no cipher suite in common")
+		}
+		reply.CipherSuite = suite.Name
+
+		if err := c.JSON("pake", reply); err != nil {
+			return err
+		}
+
+		if err := c.SetCipherSuite(suite.Name); err != nil {
+			return err
+		}
+		c.SetEncryptionKey(key)
+		return c.TurnEncryptionOn()
+	})
+	h.Action("echo", func(c hero.Context) error {
+		var body string
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		return c.JSON("echo", body)
+	})
+
+	s := herotest.NewServer(h)
+	defer s.Close()
+
+	client, err := s.Dial()
+	assert.Nil(t, err)
+	defer client.Close()
+
+	client.CipherSuites = []hero.CipherSuite{hero.ChaCha20Poly1305}
+	assert.Nil(t, Pake(client, "password", "app"))
+	assert.Equal(t, hero.ChaCha20Poly1305.Name, client.CipherSuite())
+
+	// The echo only decrypts if both ends derived the same key
+	var reply string
+	assert.Nil(t, client.Call("echo", "encrypted", &reply))
+	assert.Equal(t, "encrypted", reply)
+}
@@ -0,0 +1,51 @@
+package hero
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemdListenFdsStart is the first file descriptor systemd passes to a socket
+// activated service.
+const systemdListenFdsStart = 3
+
+// SystemdListeners returns the listeners passed in by systemd socket activation, in the
+// order they are listed in the socket unit. It returns no listeners if the process wasn't
+// socket activated. The LISTEN_* environment variables are cleared so child processes
+// don't try to use the same sockets.
+func SystemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := systemdListenFdsStart; fd < systemdListenFdsStart+count; fd++ {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+
+		// FileListener dups the descriptor, so the original can be closed
+		listener, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("file descriptor %d from systemd isn't a listener: %s", fd, err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,64 @@
+package hero
+
+// MiddlewareFunc wraps a handler. The middleware decides when, or whether, to call next,
+// so it can do work both before and after the handler runs, and can change its result.
+type MiddlewareFunc func(next HandlerFunc) HandlerFunc
+
+// Group is a set of actions that share a name prefix and middleware. Actions added to
+// the group are named prefix/name.
+type Group struct {
+	hero       *Hero
+	prefix     string
+	middleware []MiddlewareFunc
+}
+
+// Use adds middleware to the group. It runs inside the server middleware and outside
+// the middleware for each action.
+func (g *Group) Use(middleware ...MiddlewareFunc) {
+	g.middleware = append(g.middleware, middleware...)
+}
+
+// Action adds an action to the group. The action is named prefix/name.
+func (g *Group) Action(name string, handler HandlerFunc, opts ...ActionOption) {
+	g.hero.addAction(g.prefix+"/"+name, handler, g, opts...)
+}
+
+// WithMiddleware adds middleware that only runs for this action.
+func WithMiddleware(middleware ...MiddlewareFunc) ActionOption {
+	return func(a *action) {
+		a.middleware = append(a.middleware, middleware...)
+	}
+}
+
+// WrapMiddleware adapts a handler to a MiddlewareFunc. The handler runs before next, and
+// next isn't called if the handler returns an error.
+func WrapMiddleware(handler HandlerFunc) MiddlewareFunc {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c Context) error {
+			if err := handler(c); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// applyMiddleware wraps handler so that middleware[0] is the outermost layer.
+func applyMiddleware(handler HandlerFunc, middleware []MiddlewareFunc) HandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return handler
+}
+
+// chain builds the handler for an action, wrapped in the action, group and server
+// middleware. Server middleware is the outermost layer.
+func (a *action) chain(serverMiddleware []MiddlewareFunc) HandlerFunc {
+	handler := applyMiddleware(a.handler, a.middleware)
+	if a.group != nil {
+		handler = applyMiddleware(handler, a.group.middleware)
+	}
+
+	return applyMiddleware(handler, serverMiddleware)
+}
@@ -0,0 +1,82 @@
+package hero
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareWrapsActionsInOrder(t *testing.T) {
+	var calls []string
+	record := func(name string) MiddlewareFunc {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(c Context) error {
+				calls = append(calls, name+" before")
+				err := next(c)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+
+	h := NewHero("")
+	h.Use(record("server"))
+	h.AddMiddleware(func(c Context) error {
+		calls = append(calls, "legacy")
+		return nil
+	})
+
+	g := h.Group("relay", record("group"))
+	g.Action("hello", func(c Context) error {
+		calls = append(calls, "handler")
+		return nil
+	}, WithMiddleware(record("action")))
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	c := newConnection(context.Background(), h, serverConn)
+
+	assert.Nil(t, c.runMsgAction(&Message{Action: "relay/hello"}))
+	assert.Equal(t, []string{
+		"server before",
+		"legacy",
+		"group before",
+		"action before",
+		"handler",
+		"action after",
+		"group after",
+		"server after",
+	}, calls)
+
+	assert.NotNil(t, c.runMsgAction(&Message{Action: "hello"}))
+}
+
+func TestMiddlewareCanRecoverAndChangeResult(t *testing.T) {
+	recoverer := func(next HandlerFunc) HandlerFunc {
+		return func(c Context) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("recovered: %v", r)
+				}
+			}()
+			return next(c)
+		}
+	}
+
+	h := NewHero("")
+	h.Use(recoverer)
+	h.Action("panics", func(c Context) error {
+		panic("boom")
+	})
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	c := newConnection(context.Background(), h, serverConn)
+
+	assert.EqualError(t, c.runMsgAction(&Message{Action: "panics"}), "recovered: boom")
+}
@@ -0,0 +1,98 @@
+package hero
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSWithPinnedFingerprintAndClientCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hero-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	serverCert, serverKey := writeSelfSignedCert(t, dir, "server")
+	clientCert, clientKey := writeSelfSignedCert(t, dir, "client")
+
+	serverConfig, err := ServerTLSConfig(serverCert, serverKey, clientCert)
+	assert.Nil(t, err)
+
+	h := NewHero("")
+	h.TLSConfig = serverConfig
+	h.Action("echo", func(c Context) error {
+		var body string
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		return c.JSON("echo", body)
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	address := listener.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = h.Serve(ctx, listener)
+	}()
+
+	pinned := PinnedTLSConfig(Fingerprint(serverConfig.Certificates[0]))
+	clientPair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	assert.Nil(t, err)
+	pinned.Certificates = []tls.Certificate{clientPair}
+
+	var reply string
+	assert.Nil(t, connectAndEcho(address, pinned, &reply))
+	assert.Equal(t, "hello", reply)
+
+	// Without a client certificate the server rejects the connection
+	noClientCert := PinnedTLSConfig(Fingerprint(serverConfig.Certificates[0]))
+	assert.NotNil(t, connectAndEcho(address, noClientCert, &reply))
+
+	// A different pinned fingerprint fails the handshake
+	wrongPin := PinnedTLSConfig(Fingerprint(clientPair))
+	wrongPin.Certificates = []tls.Certificate{clientPair}
+	assert.NotNil(t, connectAndEcho(address, wrongPin, &reply))
+}
+
+// connectAndEcho connects to the test server at address and sends it an echo request.
+// It disconnects once the reply is read.
+func connectAndEcho(address string, config *tls.Config, reply *string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	client := NewHero("")
+	client.TLSConfig = config
+	client.Action("start", func(c Context) error {
+		if err := c.JSON("echo", "hello"); err != nil {
+			return err
+		}
+		if err := c.ReadMsg(reply); err != nil {
+			return err
+		}
+		cancel()
+		return nil
+	})
+
+	return client.Connect(ctx, address, "start")
+}
+
+func writeSelfSignedCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	certPEM, keyPEM, err := GenerateSelfSignedCert("localhost", "127.0.0.1")
+	assert.Nil(t, err)
+
+	certFile = filepath.Join(dir, name+"-cert.pem")
+	keyFile = filepath.Join(dir, name+"-key.pem")
+	assert.Nil(t, ioutil.WriteFile(certFile, certPEM, 0644))
+	assert.Nil(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+
+	return certFile, keyFile
+}
@@ -8,9 +8,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
-	"time"
 )
 
+// frameHeaderSize is the size of the length that starts every frame.
+const frameHeaderSize = 4
+
 func Write(conn net.Conn, b []byte) (int, error) {
 	header := new(bytes.Buffer)
 	// write header which is the length of the buffer we are sending
@@ -24,118 +26,125 @@ func Write(conn net.Conn, b []byte) (int, error) {
 	return conn.Write(buffer)
 }
 
+// WriteEncrypted encrypts b with AES-GCM using key and writes it as a frame.
 func WriteEncrypted(conn net.Conn, b []byte, key []byte) (int, error) {
-	var (
-		err         error
-		cipherBlock cipher.Block
-		gcm         cipher.AEAD
-	)
-	nonce := make([]byte, 12)
-	if _, err := rand.Read(nonce); err != nil {
-		return 0, err
-	}
-
-	if cipherBlock, err = aes.NewCipher(key); err != nil {
+	gcm, err := NewAESGCM(key)
+	if err != nil {
 		return 0, err
 	}
 
-	if gcm, err = cipher.NewGCM(cipherBlock); err != nil {
+	encryptedBytes, err := Seal(gcm, b)
+	if err != nil {
 		return 0, err
 	}
 
-	encryptedBytes := gcm.Seal(nil, nonce, b, nil)
-	encryptedBytes = append(nonce, encryptedBytes...)
 	return Write(conn, encryptedBytes)
 }
 
-func Read(conn net.Conn) ([]byte, int, error) {
-	bufSize, err := readHeaderBufSize(conn)
+// NewAESGCM creates an AES-GCM AEAD. The key length picks AES-128, AES-192 or AES-256.
+func NewAESGCM(key []byte) (cipher.AEAD, error) {
+	cipherBlock, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	buf := make([]byte, 0)
-	// Loop until we read bufSize or get an error
-	for {
-		// Allocate up to what we have already read, we start at a tmpBuf size equal
-		// to bufSize, and then shorten if we don't read that amount
-		tmpBuf := make([]byte, bufSize-len(buf))
-		n, err := conn.Read(tmpBuf)
-		switch {
-		case err != nil:
-			return nil, 0, err
-
-		default:
-			buf = append(buf, tmpBuf[:n]...)
-			if len(buf) == bufSize {
-				// we've read the amount expected
-				return buf, bufSize, nil
-			}
-		}
+	return cipher.NewGCM(cipherBlock)
+}
+
+// Seal encrypts b with aead using a random nonce. The nonce is put in front of the
+// encrypted bytes so Open can find it.
+func Seal(aead cipher.AEAD, b []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(b)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
 	}
+
+	return aead.Seal(nonce, nonce, b, nil), nil
 }
 
-func readHeaderBufSize(conn net.Conn) (int, error) {
-	if err := conn.SetReadDeadline(time.Now().Add(3 * time.Hour)); err != nil {
-		// log it
+// Open decrypts bytes created by Seal.
+func Open(aead cipher.AEAD, b []byte) ([]byte, error) {
+	if len(b) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted frame too short")
 	}
 
-	var header []byte
-	numBytes := 4
-	for {
-		tmp := make([]byte, numBytes-len(header))
-		n, err := conn.Read(tmp)
-		if err != nil {
-			return n, err
-		}
-
-		header = append(header, tmp[:n]...)
-		if numBytes == len(header) {
-			break
-		}
+	nonceSize := aead.NonceSize()
+	return aead.Open(nil, b[:nonceSize], b[nonceSize:], nil)
+}
+
+// SealFrame encrypts b with aead for a connection that numbers its frames. The nonce
+// is built from seq rather than sent, and the length of b is authenticated along with
+// it, so a frame only opens with the same sequence number it was sealed with. Each seq
+// must only be used once for a key.
+func SealFrame(aead cipher.AEAD, seq uint64, b []byte) ([]byte, error) {
+	nonce, err := seqNonce(aead, seq)
+	if err != nil {
+		return nil, err
 	}
 
-	return convertHeaderBytesToInt(header)
+	return aead.Seal(nil, nonce, b, frameAD(len(b))), nil
 }
 
-func convertHeaderBytesToInt(header []byte) (int, error) {
-	var bufSize uint32
-	if err := binary.Read(bytes.NewReader(header), binary.LittleEndian, &bufSize); err != nil {
-		return 0, err
+// OpenFrame decrypts a frame created by SealFrame. It fails if seq isn't the number the
+// frame was sealed with, which is how replayed, dropped and reordered frames are caught.
+func OpenFrame(aead cipher.AEAD, seq uint64, b []byte) ([]byte, error) {
+	if len(b) < aead.Overhead() {
+		return nil, fmt.Errorf("encrypted frame too short")
 	}
 
-	return int(bufSize), nil
+	nonce, err := seqNonce(aead, seq)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce, b, frameAD(len(b)-aead.Overhead()))
 }
 
-func ReadAndDecrypt(conn net.Conn, key []byte) ([]byte, int, error) {
-	var (
-		cipherBlock      cipher.Block
-		gcm              cipher.AEAD
-		err              error
-		encryptedBytes   []byte
-		unencryptedBytes []byte
-		n                int
-	)
-
-	if encryptedBytes, n, err = Read(conn); err != nil {
-		fmt.Println("Read failed")
+// seqNonce puts seq in the last 8 bytes of a nonce, big endian, with the rest zeroed.
+func seqNonce(aead cipher.AEAD, seq uint64) ([]byte, error) {
+	if aead.NonceSize() < 8 {
+		return nil, fmt.Errorf("nonce size %d is too small for a sequence number", aead.NonceSize())
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce, nil
+}
+
+// frameAD is the additional data for a frame, which is its plaintext length in the same
+// form as the frame header.
+func frameAD(n int) []byte {
+	ad := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ad, uint32(n))
+	return ad
+}
+
+// Read reads a frame written by Write, rejecting frames larger than DefaultMaxFrameSize.
+func Read(conn net.Conn) ([]byte, int, error) {
+	b, err := readFrame(conn, DefaultMaxFrameSize, nil)
+	if err != nil {
 		return nil, 0, err
 	}
 
-	if cipherBlock, err = aes.NewCipher(key); err != nil {
-		fmt.Println("NewCipher failed")
+	return b, len(b), nil
+}
+
+// ReadAndDecrypt reads a frame written by WriteEncrypted and decrypts it with key.
+func ReadAndDecrypt(conn net.Conn, key []byte) ([]byte, int, error) {
+	encryptedBytes, _, err := Read(conn)
+	if err != nil {
 		return nil, 0, err
 	}
 
-	if gcm, err = cipher.NewGCM(cipherBlock); err != nil {
-		fmt.Println("NewGCM failed")
+	gcm, err := NewAESGCM(key)
+	if err != nil {
 		return nil, 0, err
 	}
 
-	unencryptedBytes, err = gcm.Open(nil, encryptedBytes[:12], encryptedBytes[12:], nil)
+	unencryptedBytes, err := Open(gcm, encryptedBytes)
 	if err != nil {
-		fmt.Println("gcm.Open failed")
+		return nil, 0, err
 	}
 
-	return unencryptedBytes, n - 12, err
+	return unencryptedBytes, len(unencryptedBytes), nil
 }
@@ -0,0 +1,77 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultMaxFrameSize is the largest frame Read and a FrameReader accept unless told
+// otherwise.
+const DefaultMaxFrameSize = 16 * 1024 * 1024
+
+// ErrFrameTooLarge is returned when a frame header gives a length over the maximum
+// frame size. The frame isn't read, so the connection can't be used afterwards.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// FrameReader reads frames written by Write from r. It reuses its buffer from frame to
+// frame, and only grows it as far as the largest frame seen, so a peer can't make it
+// allocate more than MaxFrameSize by lying in a header. FrameReader doesn't buffer
+// anything past the end of a frame, so r can still be read directly between frames.
+type FrameReader struct {
+	// MaxFrameSize is the largest frame accepted. Zero means DefaultMaxFrameSize.
+	MaxFrameSize int
+
+	r   io.Reader
+	buf []byte
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: r, MaxFrameSize: DefaultMaxFrameSize}
+}
+
+// ReadFrame reads the next frame. The returned slice is only valid until the next
+// call to ReadFrame, so copy it if it needs to be kept.
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	maxFrameSize := fr.MaxFrameSize
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+
+	b, err := readFrame(fr.r, maxFrameSize, fr.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	fr.buf = b[:cap(b)]
+	return b, nil
+}
+
+// readFrame reads a frame into buf, allocating a new buffer if buf is too small. The
+// length in the header is checked against maxFrameSize before anything is allocated.
+func readFrame(r io.Reader, maxFrameSize int, buf []byte) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[:])
+	if uint64(size) > uint64(maxFrameSize) {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrFrameTooLarge, size, maxFrameSize)
+	}
+
+	if cap(buf) < int(size) {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,60 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameReaderReadsFramesAndReusesItsBuffer(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	go func() {
+		for _, frame := range []string{"first frame", "second", ""} {
+			_, _ = Write(clientConn, []byte(frame))
+		}
+		clientConn.Close()
+	}()
+
+	fr := NewFrameReader(serverConn)
+	b, err := fr.ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, "first frame", string(b))
+	first := &b[0]
+
+	b, err = fr.ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, "second", string(b))
+	assert.True(t, first == &b[0])
+
+	b, err = fr.ReadFrame()
+	assert.Nil(t, err)
+	assert.Len(t, b, 0)
+
+	_, err = fr.ReadFrame()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFrameReaderRejectsOversizedFrames(t *testing.T) {
+	var buf bytes.Buffer
+	_, _ = buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+
+	fr := NewFrameReader(&buf)
+	fr.MaxFrameSize = 1024
+	_, err := fr.ReadFrame()
+	assert.True(t, errors.Is(err, ErrFrameTooLarge))
+}
+
+func TestFrameReaderReportsTruncatedFrames(t *testing.T) {
+	var buf bytes.Buffer
+	_, _ = buf.Write([]byte{10, 0, 0, 0, 'a', 'b'})
+
+	_, err := NewFrameReader(&buf).ReadFrame()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
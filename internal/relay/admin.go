@@ -0,0 +1,408 @@
+package relay
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/gtarcea/ft/hero"
+	"github.com/gtarcea/ft/pkg/ft"
+)
+
+// DefaultAdminAddress is where the admin API listens unless told otherwise. It is
+// bound to localhost so the API isn't reachable from other machines by accident.
+const DefaultAdminAddress = "127.0.0.1:10002"
+
+// Reasons given in the goodbye sent to connections closed through the admin API.
+const (
+	GoodbyeClosedByAdmin = "relay closed by an administrator"
+	GoodbyeBanned        = "address banned"
+)
+
+// serverStats are the server wide counters. They are accessed atomically.
+type serverStats struct {
+	connections         int64
+	rejectedConnections int64
+	relaysSpliced       int64
+	relaysReaped        int64
+	relaysReapedSpliced int64
+	relaysClosed        int64
+	bytesRelayed        int64
+}
+
+// Stats is a snapshot of the server wide counters. RelaysReapedSpliced counts the
+// reaped relays that had already been spliced, whose connections were closed without
+// a goodbye. They are included in RelaysReaped.
+type Stats struct {
+	Connections         int64 `json:"connections"`
+	RejectedConnections int64 `json:"rejected_connections"`
+	ActiveRelays        int   `json:"active_relays"`
+	RelaysSpliced       int64 `json:"relays_spliced"`
+	RelaysReaped        int64 `json:"relays_reaped"`
+	RelaysReapedSpliced int64 `json:"relays_reaped_spliced"`
+	RelaysClosed        int64 `json:"relays_closed"`
+	BytesRelayed        int64 `json:"bytes_relayed"`
+	Bans                int   `json:"bans"`
+}
+
+// RelayInfo describes a relay for the admin API.
+type RelayInfo struct {
+	RelayID     string    `json:"relay_id"`
+	Sender      *SlotInfo `json:"sender,omitempty"`
+	Receiver    *SlotInfo `json:"receiver,omitempty"`
+	Spliced     bool      `json:"spliced"`
+	BytesMoved  int64     `json:"bytes_moved"`
+	Opened      time.Time `json:"opened"`
+	AgeSeconds  float64   `json:"age_seconds"`
+	IdleSeconds float64   `json:"idle_seconds"`
+}
+
+// SlotInfo describes a filled slot in a relay.
+type SlotInfo struct {
+	RemoteAddr string `json:"remote_addr"`
+	Ready      bool   `json:"ready"`
+}
+
+// BanInfo describes a banned address.
+type BanInfo struct {
+	Address string    `json:"address"`
+	Since   time.Time `json:"since"`
+}
+
+// Stats returns the server wide counters.
+func (s *Server) Stats() Stats {
+	s.relayList.Lock()
+	activeRelays := len(s.relayList.relays)
+	s.relayList.Unlock()
+
+	s.bansMu.Lock()
+	bans := len(s.bans)
+	s.bansMu.Unlock()
+
+	return Stats{
+		Connections:         atomic.LoadInt64(&s.stats.connections),
+		RejectedConnections: atomic.LoadInt64(&s.stats.rejectedConnections),
+		ActiveRelays:        activeRelays,
+		RelaysSpliced:       atomic.LoadInt64(&s.stats.relaysSpliced),
+		RelaysReaped:        atomic.LoadInt64(&s.stats.relaysReaped),
+		RelaysReapedSpliced: atomic.LoadInt64(&s.stats.relaysReapedSpliced),
+		RelaysClosed:        atomic.LoadInt64(&s.stats.relaysClosed),
+		BytesRelayed:        atomic.LoadInt64(&s.stats.bytesRelayed),
+		Bans:                bans,
+	}
+}
+
+// Relays describes the active relays, oldest first.
+func (s *Server) Relays() []RelayInfo {
+	now := time.Now()
+	s.relayList.Lock()
+	relays := make([]RelayInfo, 0, len(s.relayList.relays))
+	for _, relay := range s.relayList.relays {
+		relays = append(relays, RelayInfo{
+			RelayID:     relay.relayID,
+			Sender:      slotInfo(relay.sender),
+			Receiver:    slotInfo(relay.receiver),
+			Spliced:     relay.spliced,
+			BytesMoved:  atomic.LoadInt64(&relay.bytesMoved),
+			Opened:      relay.opened,
+			AgeSeconds:  now.Sub(relay.opened).Seconds(),
+			IdleSeconds: relay.idleFor(now).Seconds(),
+		})
+	}
+	s.relayList.Unlock()
+
+	sort.Slice(relays, func(i, j int) bool {
+		return relays[i].Opened.Before(relays[j].Opened)
+	})
+
+	return relays
+}
+
+func slotInfo(slot *Slot) *SlotInfo {
+	if slot == nil {
+		return nil
+	}
+
+	return &SlotInfo{RemoteAddr: slot.connection.RemoteAddr().String(), Ready: slot.ready}
+}
+
+// CloseRelay closes the relay for relayID, saying goodbye to both ends unless it has
+// been spliced. It returns false if there is no such relay.
+func (s *Server) CloseRelay(relayID string) bool {
+	s.relayList.Lock()
+	relay, ok := s.relayList.relays[relayID]
+	var ended *endedRelay
+	if ok {
+		atomic.AddInt64(&s.stats.relaysClosed, 1)
+		ended = s.endRelayLocked(relayID, relay, GoodbyeClosedByAdmin)
+	}
+	s.relayList.Unlock()
+
+	if ended != nil {
+		ended.close()
+	}
+
+	return ok
+}
+
+// Ban stops the relay accepting connections from address, which can be given with or
+// without a port. Relays with a slot from the address are closed, as are connections
+// from it that are still authenticating or haven't said hello.
+func (s *Server) Ban(address string) {
+	host := hostOf(address)
+	s.bansMu.Lock()
+	if _, ok := s.bans[host]; !ok {
+		s.bans[host] = time.Now()
+	}
+	s.bansMu.Unlock()
+
+	// Connections in an ended relay are closed along with it, after their goodbye
+	inRelay := make(map[string]bool)
+	var ended []*endedRelay
+	s.relayList.Lock()
+	for relayKey, relay := range s.relayList.relays {
+		slots := []*Slot{relay.sender, relay.receiver}
+		banned := false
+		for _, slot := range slots {
+			if slot != nil && hostOf(slot.connection.RemoteAddr().String()) == host {
+				banned = true
+			}
+		}
+		if !banned {
+			continue
+		}
+
+		if e := s.endRelayLocked(relayKey, relay, GoodbyeBanned); e != nil {
+			ended = append(ended, e)
+		}
+		for _, slot := range slots {
+			if slot != nil {
+				inRelay[slot.id] = true
+			}
+		}
+	}
+	s.relayList.Unlock()
+
+	for _, e := range ended {
+		e.close()
+	}
+
+	s.heroMu.Lock()
+	h := s.hero
+	s.heroMu.Unlock()
+	if h == nil {
+		return
+	}
+
+	for _, c := range h.Connections() {
+		if !inRelay[c.ID()] && hostOf(c.RemoteAddr().String()) == host {
+			_ = c.Conn().Close()
+		}
+	}
+}
+
+// Unban lifts the ban on address. It returns false if the address wasn't banned.
+func (s *Server) Unban(address string) bool {
+	host := hostOf(address)
+	s.bansMu.Lock()
+	defer s.bansMu.Unlock()
+	_, ok := s.bans[host]
+	delete(s.bans, host)
+	return ok
+}
+
+// Bans lists the banned addresses, in the order they were banned.
+func (s *Server) Bans() []BanInfo {
+	s.bansMu.Lock()
+	bans := make([]BanInfo, 0, len(s.bans))
+	for address, since := range s.bans {
+		bans = append(bans, BanInfo{Address: address, Since: since})
+	}
+	s.bansMu.Unlock()
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Since.Before(bans[j].Since)
+	})
+
+	return bans
+}
+
+func (s *Server) isBanned(address string) bool {
+	s.bansMu.Lock()
+	defer s.bansMu.Unlock()
+	_, ok := s.bans[hostOf(address)]
+	return ok
+}
+
+// connectHandler counts connections and turns away those from banned addresses.
+func (s *Server) connectHandler(c hero.Context) error {
+	atomic.AddInt64(&s.stats.connections, 1)
+	if s.isBanned(c.RemoteAddr().String()) {
+		atomic.AddInt64(&s.stats.rejectedConnections, 1)
+		return ft.ErrAddressBanned
+	}
+
+	return nil
+}
+
+// hostOf strips the port from address, and puts IP addresses in their usual form so
+// the same address is always banned under the same name.
+func hostOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+
+	return host
+}
+
+// startAdmin starts the admin API on AdminAddress when there is an AdminToken. It runs
+// until c is cancelled.
+func (s *Server) startAdmin(c context.Context) error {
+	if s.AdminToken == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", s.AdminAddress)
+	if err != nil {
+		return fmt.Errorf("unable to start admin API: %s", err)
+	}
+
+	server := &http.Server{Handler: s.AdminHandler()}
+	go func() {
+		<-c.Done()
+		_ = server.Close()
+	}()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Admin API stopped: %s", err)
+		}
+	}()
+
+	log.Infof("Admin API listening on %s", listener.Addr())
+	return nil
+}
+
+// AdminHandler returns the admin API. Every request needs an Authorization header
+// with AdminToken as a bearer token. The endpoints are:
+//
+//	GET    /relays          list the active relays
+//	DELETE /relays/{id}     close a relay
+//	GET    /bans            list the banned addresses
+//	POST   /bans            ban {"address": "..."}
+//	DELETE /bans/{address}  lift a ban
+//	GET    /stats           server wide counters
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/relays", s.relaysHandler)
+	mux.HandleFunc("/relays/", s.relayHandler)
+	mux.HandleFunc("/bans", s.bansHandler)
+	mux.HandleFunc("/bans/", s.banHandler)
+	mux.HandleFunc("/stats", s.statsHandler)
+	return s.requireAdminToken(mux)
+}
+
+func (s *Server) requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := []byte("Bearer " + s.AdminToken)
+		given := []byte(r.Header.Get("Authorization"))
+		if s.AdminToken == "" || subtle.ConstantTimeCompare(given, expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) relaysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.Relays())
+}
+
+func (s *Server) relayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodDelete)
+		return
+	}
+
+	if !s.CloseRelay(strings.TrimPrefix(r.URL.Path, "/relays/")) {
+		http.Error(w, "no such relay", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) bansHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.Bans())
+	case http.MethodPost:
+		var ban struct {
+			Address string `json:"address"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&ban); err != nil || ban.Address == "" {
+			http.Error(w, "expected {\"address\": \"...\"}", http.StatusBadRequest)
+			return
+		}
+
+		s.Ban(ban.Address)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (s *Server) banHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodDelete)
+		return
+	}
+
+	if !s.Unban(strings.TrimPrefix(r.URL.Path, "/bans/")) {
+		http.Error(w, "address isn't banned", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.Stats())
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Unable to write admin response: %s", err)
+	}
+}
@@ -0,0 +1,170 @@
+package relay
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gtarcea/ft/hero/herotest"
+	"github.com/gtarcea/ft/hero/herotest/paketest"
+	"github.com/gtarcea/ft/pkg/msgs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminRequiresToken(t *testing.T) {
+	relay := NewServer("", "")
+	relay.AdminToken = "admin-token"
+	admin := httptest.NewServer(relay.AdminHandler())
+	defer admin.Close()
+
+	resp, err := http.Get(admin.URL + "/stats")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = adminRequest(t, admin, "wrong-token", http.MethodGet, "/stats", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = adminRequest(t, admin, "admin-token", http.MethodGet, "/stats", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestAdminListsAndClosesRelays(t *testing.T) {
+	relay := NewServer("", "")
+	relay.AdminToken = "admin-token"
+	admin := httptest.NewServer(relay.AdminHandler())
+	defer admin.Close()
+	s := herotest.StartServer(relay.Serve)
+	defer s.Close()
+
+	sender := connectAndWait(t, s, "admin-relay-key", Sender)
+	defer sender.Close()
+	receiver := connectAndSayHello(t, s, "admin-relay-key", Receiver)
+	defer receiver.Close()
+	assert.Nil(t, sender.Expect("peer_joined", nil))
+	assert.Nil(t, receiver.Expect("peer_joined", nil))
+
+	var relays []RelayInfo
+	resp := adminRequest(t, admin, "admin-token", http.MethodGet, "/relays", "")
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&relays))
+	resp.Body.Close()
+	assert.Len(t, relays, 1)
+	assert.Equal(t, "admin-relay-key", relays[0].RelayID)
+	assert.Equal(t, "pipe", relays[0].Sender.RemoteAddr)
+	assert.NotNil(t, relays[0].Receiver)
+	assert.False(t, relays[0].Spliced)
+
+	var stats Stats
+	resp = adminRequest(t, admin, "admin-token", http.MethodGet, "/stats", "")
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&stats))
+	resp.Body.Close()
+	assert.Equal(t, int64(2), stats.Connections)
+	assert.Equal(t, 1, stats.ActiveRelays)
+
+	// Closing writes the goodbyes before replying, so it has to run while they're read
+	status := make(chan int, 1)
+	go func() {
+		resp := adminRequest(t, admin, "admin-token", http.MethodDelete, "/relays/admin-relay-key", "")
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	var goodbye msgs.Goodbye
+	assert.Nil(t, sender.Expect("goodbye", &goodbye))
+	assert.Equal(t, GoodbyeClosedByAdmin, goodbye.Reason)
+	assert.Nil(t, receiver.Expect("goodbye", &goodbye))
+	assert.Equal(t, http.StatusNoContent, <-status)
+	assert.Len(t, relay.Relays(), 0)
+
+	resp = adminRequest(t, admin, "admin-token", http.MethodDelete, "/relays/admin-relay-key", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAdminBansAddresses(t *testing.T) {
+	relay := NewServer("", "")
+	relay.AdminToken = "admin-token"
+	admin := httptest.NewServer(relay.AdminHandler())
+	defer admin.Close()
+	s := herotest.StartServer(relay.Serve)
+	defer s.Close()
+
+	resp := adminRequest(t, admin, "admin-token", http.MethodPost, "/bans", `{"address": "pipe"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	var bans []BanInfo
+	resp = adminRequest(t, admin, "admin-token", http.MethodGet, "/bans", "")
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&bans))
+	resp.Body.Close()
+	assert.Len(t, bans, 1)
+	assert.Equal(t, "pipe", bans[0].Address)
+
+	client, err := s.Dial()
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.NotNil(t, paketest.Pake(client, Password, AppId))
+	assert.Equal(t, int64(1), relay.Stats().RejectedConnections)
+
+	resp = adminRequest(t, admin, "admin-token", http.MethodDelete, "/bans/pipe", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	client, err = s.Dial()
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Nil(t, paketest.Pake(client, Password, AppId))
+}
+
+func TestBanClosesConnectionsNotYetInARelay(t *testing.T) {
+	relay := NewServer("", "")
+	s := herotest.StartServer(relay.Serve)
+	defer s.Close()
+
+	// One connection has authenticated but not said hello, the other hasn't started
+	authenticated, err := s.Dial()
+	assert.Nil(t, err)
+	defer authenticated.Close()
+	assert.Nil(t, paketest.Pake(authenticated, Password, AppId))
+
+	idle, err := s.Dial()
+	assert.Nil(t, err)
+	defer idle.Close()
+	assert.Eventually(t, func() bool {
+		return relay.Stats().Connections == 2
+	}, 3*time.Second, 10*time.Millisecond)
+
+	relay.Ban("pipe")
+
+	for _, client := range []*herotest.Client{authenticated, idle} {
+		client.Timeout = time.Second
+		_, err := client.Read()
+		assert.Equal(t, io.EOF, err)
+	}
+}
+
+func TestHostOfNormalizesAddresses(t *testing.T) {
+	assert.Equal(t, "10.0.0.1", hostOf("10.0.0.1:4000"))
+	assert.Equal(t, "10.0.0.1", hostOf("10.0.0.1"))
+	assert.Equal(t, "::1", hostOf("[::1]:4000"))
+	assert.Equal(t, "2001:db8::1", hostOf("2001:DB8:0::1"))
+}
+
+func adminRequest(t *testing.T, admin *httptest.Server, token, method, path, body string) *http.Response {
+	req, err := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	return resp
+}
@@ -2,9 +2,13 @@ package relay
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gtarcea/ft/pkg/ft"
@@ -19,22 +23,139 @@ const (
 	Sender   = "sender"
 )
 
+// Password and AppId are the SPAKE2 password and app ID a Server authenticates with
+// when it isn't given its own. Anyone who knows the defaults can use the relay, so a
+// public relay should be configured with something else.
 const Password = "abc123"
 const AppId = "relay-app-id"
 
+// relayKeyContextKey is the connection store key holding the relay key a connection
+// said hello with.
+const relayKeyContextKey = "relay.key"
+
+// Defaults for the Server's reaper limits.
+const (
+	DefaultWaitTimeout    = 10 * time.Minute
+	DefaultIdleTimeout    = 10 * time.Minute
+	DefaultMaxSessionTime = 24 * time.Hour
+	DefaultReapInterval   = 30 * time.Second
+)
+
+// Defaults for how the Server notices connections that have gone away without closing.
+const (
+	DefaultHeartbeatInterval = 30 * time.Second
+	DefaultHeartbeatTimeout  = 2 * time.Minute
+)
+
+// Reasons given in the goodbye sent to connections whose relay is reaped before it is
+// spliced. Spliced relays are closed without a goodbye, since their connections only
+// carry the peers' own bytes.
+const (
+	GoodbyePeerNeverJoined = "peer never joined"
+	GoodbyeIdle            = "relay idle for too long"
+	GoodbyeSessionTooLong  = "relay session time limit reached"
+)
+
+// noticeTimeout bounds writing a goodbye or go, so a peer that isn't reading can't
+// hold up the relay.
+const noticeTimeout = 5 * time.Second
+
+// maxFrameSize is the largest frame the relay reads. Before connections are spliced
+// the relay only exchanges small control messages, so anything bigger is a client
+// trying to make it allocate.
+const maxFrameSize = 64 * 1024
+
 type Slot struct {
 	connection net.Conn
 	mtype      string
+
+	// id is the hero connection ID, used to push notices to the slot's connection
+	id string
+
+	// ctx is the slot's hero connection, used to say goodbye when the relay is reaped
+	ctx hero.Context
+
+	// ready is set once the connection has sent ready and been hijacked from hero
+	ready bool
+
+	// externalIPs is what the connection sent in external_ips, with the address the
+	// relay sees it connecting from. It is nil until external_ips is sent.
+	externalIPs *msgs.ExternalIPs
 }
 
 type Relay struct {
+	// lastUsed is when the relay last saw a hello, go or relayed bytes, in Unix
+	// nanoseconds. bytesMoved counts the bytes relayed. They are accessed atomically
+	// since pipes update them without the lock.
+	lastUsed   int64
+	bytesMoved int64
+
 	sender     *Slot
 	receiver   *Slot
 	spake      *gospake2.SPAKE2
 	derivedKey []byte
 	opened     time.Time
-	lastUsed   time.Time
 	relayID    string
+
+	// slotProof is the proof of the relay key's secret given by the first party to
+	// arrive, if any. The second party has to give the same proof, or none if the first
+	// didn't, see slotProofsMatch.
+	slotProof []byte
+
+	// spliced is set once connectSlots has taken over both connections
+	spliced bool
+
+	// reaped is sent the reason when a spliced relay is ended, so connectSlots can stop
+	// piping and close both connections.
+	reaped chan string
+}
+
+func newRelay(relayID string) *Relay {
+	relay := &Relay{opened: time.Now(), relayID: relayID, reaped: make(chan string, 1)}
+	relay.touch()
+	return relay
+}
+
+// touch marks the relay as used now.
+func (r *Relay) touch() {
+	atomic.StoreInt64(&r.lastUsed, time.Now().UnixNano())
+}
+
+// idleFor returns how long it has been since the relay was last used.
+func (r *Relay) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&r.lastUsed)))
+}
+
+// paired returns true when both the sender and receiver slots are filled. It must be
+// called with the relayList locked.
+func (r *Relay) paired() bool {
+	return r.sender != nil && r.receiver != nil
+}
+
+// slotFor returns the slot holding conn, or nil if conn isn't in the relay. It must be
+// called with the relayList locked.
+func (r *Relay) slotFor(conn net.Conn) *Slot {
+	switch {
+	case r.sender != nil && r.sender.connection == conn:
+		return r.sender
+	case r.receiver != nil && r.receiver.connection == conn:
+		return r.receiver
+	default:
+		return nil
+	}
+}
+
+// peerOf returns the other slot in the relay from slot, or nil if it is empty. It must
+// be called with the relayList locked.
+func (r *Relay) peerOf(slot *Slot) *Slot {
+	switch {
+	case slot == nil:
+		return nil
+	case slot == r.sender:
+		return r.receiver
+	default:
+		return r.sender
+	}
 }
 
 type Message struct {
@@ -48,40 +169,145 @@ type relayList struct {
 }
 
 type Server struct {
+	// stats is first so its counters are 64 bit aligned for atomic access.
+	stats serverStats
+
+	// TLSConfig turns on TLS for connections to the relay when set.
+	TLSConfig *tls.Config
+
+	// AppID is the SPAKE2 identity clients have to use along with the password. It
+	// defaults to AppId.
+	AppID string
+
+	// RequireSlotSecret makes every hello carry a proof of a secret for its relay key,
+	// see ft.SlotProof, so knowing a relay key isn't enough to join it. When it is off
+	// a hello may leave the proof out, but the two parties are only paired if neither
+	// gave one or both gave the same one.
+	RequireSlotSecret bool
+
+	// WaitTimeout is how long the first party to arrive waits for its peer before the
+	// relay is reaped.
+	WaitTimeout time.Duration
+
+	// IdleTimeout is how long a relay with both parties can go without relaying
+	// anything before it is reaped.
+	IdleTimeout time.Duration
+
+	// MaxSessionTime is the longest a relay can exist, however busy it is.
+	MaxSessionTime time.Duration
+
+	// HeartbeatInterval is how often the relay pings a connection that has gone quiet,
+	// and HeartbeatTimeout is how long a connection can go without sending anything,
+	// pings and pongs included, before it is dropped. They free the slot of a client
+	// that vanished without closing its connection. Spliced connections carry the
+	// peers' bytes so they aren't pinged, the reaper's IdleTimeout covers them.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	// ReapInterval is how often relays are checked against the limits above. Zero
+	// turns the reaper off, as does zero for a single limit. Once a relay is spliced
+	// its connections carry the peers' raw bytes, so the reaper can't send them a
+	// goodbye and simply hangs up. Those relays are counted apart in Stats as
+	// RelaysReapedSpliced.
+	ReapInterval time.Duration
+
+	// AdminToken turns on the admin HTTP API on AdminAddress. Requests have to carry
+	// it as a bearer token.
+	AdminToken   string
+	AdminAddress string
+
+	// bans holds the banned IP addresses, see Ban.
+	bans   map[string]time.Time
+	bansMu sync.Mutex
+
+	// hero is the hero the relay is served with, set once Start or Serve is called.
+	// Ban uses it to find connections that haven't joined a relay yet.
+	hero   *hero.Hero
+	heroMu sync.Mutex
+
 	relayList relayList
 	address   string
 	password  string
 	states    *ft.State
+	ctx       context.Context
 }
 
+// NewServer creates a relay listening on address. Clients authenticate with password,
+// or with Password when it is empty.
 func NewServer(address string, password string) *Server {
+	if password == "" {
+		password = Password
+	}
+
 	server := &Server{
-		address:   address,
-		password:  password,
-		relayList: relayList{relays: make(map[string]*Relay)},
-		states:    ft.NewState(),
+		address:           address,
+		password:          password,
+		AppID:             AppId,
+		relayList:         relayList{relays: make(map[string]*Relay)},
+		states:            ft.NewState(),
+		WaitTimeout:       DefaultWaitTimeout,
+		IdleTimeout:       DefaultIdleTimeout,
+		MaxSessionTime:    DefaultMaxSessionTime,
+		HeartbeatInterval: DefaultHeartbeatInterval,
+		HeartbeatTimeout:  DefaultHeartbeatTimeout,
+		ReapInterval:      DefaultReapInterval,
+		AdminAddress:      DefaultAdminAddress,
+		bans:              make(map[string]time.Time),
 	}
 
 	server.states.AddState("start", "pake")
 	server.states.AddState("pake", "hello")
-	server.states.AddState("hello", "external_ips", "go")
-	server.states.AddState("external_ips", "go")
+	server.states.AddState("hello", "external_ips", "ready")
+	server.states.AddState("external_ips", "ready")
 	server.states.SetStartState("start")
 
 	return server
 }
 
+// Start listens on the server's address and runs the relay until c is cancelled.
 func (s *Server) Start(c context.Context) error {
+	if err := s.startAdmin(c); err != nil {
+		return err
+	}
+
+	return s.newHero(c).Start(c)
+}
+
+// Serve runs the relay on listener until c is cancelled. It is used when the listener
+// comes from somewhere else, such as systemd socket activation.
+func (s *Server) Serve(c context.Context, listener net.Listener) error {
+	if err := s.startAdmin(c); err != nil {
+		return err
+	}
+
+	return s.newHero(c).Serve(c, listener)
+}
+
+func (s *Server) newHero(c context.Context) *hero.Hero {
+	s.ctx = c
 	h := hero.NewHero(s.address)
-	h.AddMiddleware(s.validStateMiddleware)
+	h.Codecs = []hero.Codec{hero.CBORCodec, hero.JSONCodec}
+	h.TLSConfig = s.TLSConfig
+	h.MaxFrameSize = maxFrameSize
+	h.HeartbeatInterval = s.HeartbeatInterval
+	h.IdleTimeout = s.HeartbeatTimeout
+	h.AddMiddleware(ft.StateMiddleware(s.states))
 	h.Action("pake", s.authenticateHandler)
 	h.Action("hello", s.helloHandler)
+	h.Action("external_ips", s.externalIPsHandler)
 	h.Action("ready", s.readyHandler)
-	return h.Start(c)
-}
+	h.OnConnect(s.connectHandler)
+	h.OnDisconnect(s.disconnectHandler)
+
+	s.heroMu.Lock()
+	s.hero = h
+	s.heroMu.Unlock()
+
+	if s.ReapInterval > 0 {
+		go s.reapRelays(c)
+	}
 
-func (s *Server) validStateMiddleware(c hero.Context) error {
-	return s.states.ValidateAndAdvanceToNextState(c.Action())
+	return h
 }
 
 func (s *Server) authenticateHandler(c hero.Context) error {
@@ -91,8 +317,8 @@ func (s *Server) authenticateHandler(c hero.Context) error {
 		return err
 	}
 
-	pw := gospake2.NewPassword(Password)
-	spake := gospake2.SPAKE2Symmetric(pw, gospake2.NewIdentityS(AppId))
+	pw := gospake2.NewPassword(s.password)
+	spake := gospake2.SPAKE2Symmetric(pw, gospake2.NewIdentityS(s.AppID))
 	pakeMsgBody := spake.Start()
 	sharedKey, err := spake.Finish(pakeMsg.Body)
 
@@ -101,15 +327,34 @@ func (s *Server) authenticateHandler(c hero.Context) error {
 		return err
 	}
 	pakeMsg2 := msgs.Pake{Body: pakeMsgBody}
+	if len(pakeMsg.CipherSuites) != 0 {
+		suite, ok := c.Hero().ChooseCipherSuite(pakeMsg.CipherSuites)
+		if !ok {
+			return ft.ErrNoCommonCipherSuite
+		}
+		pakeMsg2.CipherSuite = suite.Name
+	}
+
 	if err := c.JSON("pake", pakeMsg2); err != nil {
 		fmt.Println("failed writing return pake msg:", err)
 		return err
 	}
 
+	if pakeMsg2.CipherSuite != "" {
+		if err := c.SetCipherSuite(pakeMsg2.CipherSuite); err != nil {
+			return err
+		}
+	}
+
 	c.SetEncryptionKey(sharedKey)
 	return c.TurnEncryptionOn()
 }
 
+// helloHandler puts the connection into its relay's slot. The first connection to
+// arrive is told it is waiting, and waits for its peer in hero's read loop so a
+// connection that drops while waiting is noticed. When the second one arrives both
+// are sent a peer_joined notice, after which each sends ready. Once both are ready
+// the relay sends go and the connections are piped to each other.
 func (s *Server) helloHandler(c hero.Context) error {
 	var hello msgs.Hello
 	if err := c.Bind(&hello); err != nil {
@@ -118,39 +363,80 @@ func (s *Server) helloHandler(c hero.Context) error {
 
 	fmt.Printf("Got hello with relaykey: %s and connection type: %s\n", hello.RelayKey, hello.ConnectionType)
 
+	peer, err := s.addToRelay(hello, c)
+	if err != nil {
+		return err
+	}
+
+	c.Set(relayKeyContextKey, hello.RelayKey)
+
+	if peer == nil {
+		return c.JSON("waiting", msgs.Waiting{WaitingFor: peerConnectionType(hello.ConnectionType)})
+	}
+
+	if err := c.Hero().Send(peer.id, "peer_joined", msgs.PeerJoined{ConnectionType: hello.ConnectionType}); err != nil {
+		fmt.Println("Unable to tell waiting peer it has been joined:", err)
+	}
+
+	return c.JSON("peer_joined", msgs.PeerJoined{ConnectionType: peer.mtype})
+}
+
+// peerConnectionType returns the connection type that pairs with connectionType.
+func peerConnectionType(connectionType string) string {
+	if connectionType == Sender {
+		return Receiver
+	}
+
+	return Sender
+}
+
+// addToRelay places the connection into the slot for its connection type, creating the
+// relay if this is the first connection to arrive for the relay key. It returns the
+// slot of the peer that was already waiting, or nil if this connection is first.
+func (s *Server) addToRelay(hello msgs.Hello, c hero.Context) (*Slot, error) {
+	if hello.ConnectionType != Sender && hello.ConnectionType != Receiver {
+		return nil, ft.ErrInvalidConnectionType
+	}
+
 	s.relayList.Lock()
 	defer s.relayList.Unlock()
+
+	if s.RequireSlotSecret && len(hello.SlotProof) == 0 {
+		return nil, ft.ErrSlotSecretRequired
+	}
+
+	slot := &Slot{connection: c.Conn(), mtype: hello.ConnectionType, id: c.ID(), ctx: c}
 	relay, foundRelay := s.relayList.relays[hello.RelayKey]
 
 	if foundRelay {
 		// Found an existing relay
+		var peer *Slot
 		switch {
+		case relay.paired():
+			return nil, ft.ErrRelaySlotsFull
+		case !slotProofsMatch(relay.slotProof, hello.SlotProof):
+			return nil, ft.ErrSlotSecretMismatch
 		case hello.ConnectionType == Receiver && relay.receiver != nil:
-			return fmt.Errorf("already have a receiver")
+			return nil, ft.ErrAlreadyHaveReceiver
 		case hello.ConnectionType == Sender && relay.sender != nil:
-			return fmt.Errorf("already have a sender")
-		case relay.receiver != nil && relay.sender != nil:
-			return fmt.Errorf("relay slots full")
+			return nil, ft.ErrAlreadyHaveSender
 		case hello.ConnectionType == Receiver:
-			relay.receiver = &Slot{connection: c.Conn(), mtype: Receiver}
-		case hello.ConnectionType == Sender:
-			relay.sender = &Slot{connection: c.Conn(), mtype: Sender}
+			relay.receiver = slot
+			peer = relay.sender
 		default:
-			// should never happen
+			relay.sender = slot
+			peer = relay.receiver
 		}
 
-		return nil
+		relay.touch()
+		return peer, nil
 	}
 
 	// No relay found so create one
 
-	relay = &Relay{
-		opened:   time.Now(),
-		lastUsed: time.Now(),
-		relayID:  hello.RelayKey,
-	}
+	relay = newRelay(hello.RelayKey)
+	relay.slotProof = hello.SlotProof
 
-	slot := &Slot{connection: c.Conn(), mtype: hello.ConnectionType}
 	if hello.ConnectionType == Sender {
 		relay.sender = slot
 	} else {
@@ -159,10 +445,330 @@ func (s *Server) helloHandler(c hero.Context) error {
 
 	s.relayList.relays[hello.RelayKey] = relay
 
-	return nil
+	return nil, nil
+}
+
+// slotProofsMatch reports whether the slot proofs of the two parties to a relay agree.
+// They do if neither party gave one. Otherwise a party with a secret would pair with
+// anyone who knew the relay key, so one missing proof is a mismatch.
+func slotProofsMatch(first, second []byte) bool {
+	if len(first) == 0 && len(second) == 0 {
+		return true
+	}
+
+	return hmac.Equal(first, second)
 }
 
+// externalIPsHandler records the local addresses a client sent along with the address
+// the relay sees for it, and swaps them with the peer's. The client is told the address
+// it was seen at, plus the peer's addresses if the peer has already sent them. If it
+// hasn't, the peer is sent this client's addresses when it does, so both sides end up
+// with both sets.
+func (s *Server) externalIPsHandler(c hero.Context) error {
+	var ips msgs.ExternalIPs
+	if err := c.Bind(&ips); err != nil {
+		return err
+	}
+
+	ips.ObservedAddress = c.RemoteAddr().String()
+	relayKey, _ := c.Get(relayKeyContextKey).(string)
+
+	s.relayList.Lock()
+	relay, ok := s.relayList.relays[relayKey]
+	var slot, peer *Slot
+	if ok {
+		slot = relay.slotFor(c.Conn())
+		peer = relay.peerOf(slot)
+	}
+	if slot != nil {
+		slot.externalIPs = &ips
+	}
+
+	reply := msgs.ExternalIPsReply{ObservedAddress: ips.ObservedAddress}
+	if peer != nil {
+		reply.Peer = peer.externalIPs
+	}
+	s.relayList.Unlock()
+
+	if slot == nil {
+		return ft.ErrPeerNotJoined
+	}
+
+	if reply.Peer != nil {
+		if err := c.Hero().Send(peer.id, "peer_external_ips", ips); err != nil {
+			fmt.Println("Unable to send external ips to peer:", err)
+		}
+	}
+
+	return c.JSON("external_ips", reply)
+}
+
+// readyHandler hijacks the connection from hero so its bytes can be relayed to the
+// peer. Once both sides are ready the relay tells them go and starts piping between
+// them.
 func (s *Server) readyHandler(c hero.Context) error {
-	_ = c
+	relayKey, _ := c.Get(relayKeyContextKey).(string)
+
+	s.relayList.Lock()
+	defer s.relayList.Unlock()
+
+	relay, ok := s.relayList.relays[relayKey]
+	if !ok || !relay.paired() {
+		return ft.ErrPeerNotJoined
+	}
+
+	slot := relay.slotFor(c.Conn())
+	if slot == nil {
+		return ft.ErrPeerNotJoined
+	}
+
+	c.Hijack()
+	slot.ready = true
+	relay.touch()
+
+	if relay.sender.ready && relay.receiver.ready {
+		relay.spliced = true
+		atomic.AddInt64(&s.stats.relaysSpliced, 1)
+		go s.connectSlots(relay)
+	}
+
 	return nil
 }
+
+// connectSlots sends go to the sender and receiver, then pipes bytes in both
+// directions between them until either side closes its connection. It then closes
+// both connections and removes the relay.
+func (s *Server) connectSlots(relay *Relay) {
+	sender := relay.sender.connection
+	receiver := relay.receiver.connection
+
+	// go is the last message from the relay, everything after it comes from the peer
+	for _, slot := range []*Slot{relay.sender, relay.receiver} {
+		_ = slot.connection.SetWriteDeadline(time.Now().Add(noticeTimeout))
+		if err := slot.ctx.WriteMsg("go", nil); err != nil {
+			fmt.Println("Unable to send go:", err)
+			_ = sender.Close()
+			_ = receiver.Close()
+			s.removeRelay(relay)
+			return
+		}
+	}
+
+	// Hero sets a read deadline on every message read. Clear it so an idle pipe
+	// isn't torn down.
+	_ = sender.SetDeadline(time.Time{})
+	_ = receiver.SetDeadline(time.Time{})
+
+	done := make(chan struct{}, 2)
+	go s.pipe(receiver, sender, relay, done)
+	go s.pipe(sender, receiver, relay, done)
+
+	select {
+	case <-done:
+	case <-s.ctx.Done():
+	case reason := <-relay.reaped:
+		// Both ends have been sent go, so a goodbye would land in the middle of the
+		// peers' bytes. Closing the connections is all that can be done.
+		fmt.Printf("Closing relay %s: %s\n", relay.relayID, reason)
+	}
+
+	_ = sender.Close()
+	_ = receiver.Close()
+
+	s.removeRelay(relay)
+}
+
+// pipe copies from src to dst until src is closed or an error occurs.
+func (s *Server) pipe(dst, src net.Conn, relay *Relay, done chan<- struct{}) {
+	_, _ = io.Copy(&meteredWriter{w: dst, relay: relay, stats: &s.stats}, src)
+	done <- struct{}{}
+}
+
+// meteredWriter marks its relay as used on every write, and counts the bytes written.
+type meteredWriter struct {
+	w     io.Writer
+	relay *Relay
+	stats *serverStats
+}
+
+func (m *meteredWriter) Write(p []byte) (int, error) {
+	m.relay.touch()
+	n, err := m.w.Write(p)
+	atomic.AddInt64(&m.relay.bytesMoved, int64(n))
+	atomic.AddInt64(&m.stats.bytesRelayed, int64(n))
+	return n, err
+}
+
+// reapRelays removes relays that have gone past one of the server's limits every
+// ReapInterval until c is cancelled.
+func (s *Server) reapRelays(c context.Context) {
+	ticker := time.NewTicker(s.ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Done():
+			return
+		case now := <-ticker.C:
+			s.reap(now)
+		}
+	}
+}
+
+// reap removes the relays that have gone past a limit at now. Both ends of a reaped
+// relay are closed, and are sent a goodbye with the reason first unless the relay has
+// been spliced. A spliced relay's connections are raw streams between the peers, and
+// a goodbye written into them would reach the peer as part of its data.
+func (s *Server) reap(now time.Time) {
+	var ended []*endedRelay
+	s.relayList.Lock()
+	for relayKey, relay := range s.relayList.relays {
+		reason := s.expiredReason(relay, now)
+		if reason == "" {
+			continue
+		}
+
+		atomic.AddInt64(&s.stats.relaysReaped, 1)
+		if relay.spliced {
+			atomic.AddInt64(&s.stats.relaysReapedSpliced, 1)
+		}
+		if e := s.endRelayLocked(relayKey, relay, reason); e != nil {
+			ended = append(ended, e)
+		}
+	}
+	s.relayList.Unlock()
+
+	for _, e := range ended {
+		e.close()
+	}
+}
+
+// endedRelay is a relay that has been taken out of the relayList so it can be closed.
+type endedRelay struct {
+	relay  *Relay
+	reason string
+}
+
+// endRelayLocked ends relay for reason. Spliced relays are handed to their
+// connectSlots, which owns the connections and closes them, and nil is returned. Other relays are
+// removed from the relayList and returned, to be closed once the lock is released. It
+// must be called with the relayList locked.
+func (s *Server) endRelayLocked(relayKey string, relay *Relay, reason string) *endedRelay {
+	if relay.spliced {
+		select {
+		case relay.reaped <- reason:
+		default:
+			// Already told to stop
+		}
+		return nil
+	}
+
+	delete(s.relayList.relays, relayKey)
+	return &endedRelay{relay: relay, reason: reason}
+}
+
+// close says goodbye to both ends of the relay and closes them. The relay is no
+// longer in the list, so the disconnect handlers leave it alone.
+func (e *endedRelay) close() {
+	sayGoodbye(e.reason, e.relay.sender, e.relay.receiver)
+	for _, slot := range []*Slot{e.relay.sender, e.relay.receiver} {
+		if slot != nil {
+			_ = slot.connection.Close()
+		}
+	}
+}
+
+// expiredReason returns why relay has gone past one of the server's limits at now, or
+// the empty string if it hasn't. It must be called with the relayList locked.
+func (s *Server) expiredReason(relay *Relay, now time.Time) string {
+	switch {
+	case s.MaxSessionTime > 0 && now.Sub(relay.opened) > s.MaxSessionTime:
+		return GoodbyeSessionTooLong
+	case !relay.paired() && s.WaitTimeout > 0 && now.Sub(relay.opened) > s.WaitTimeout:
+		return GoodbyePeerNeverJoined
+	case relay.paired() && s.IdleTimeout > 0 && relay.idleFor(now) > s.IdleTimeout:
+		return GoodbyeIdle
+	default:
+		return ""
+	}
+}
+
+// sayGoodbye sends a goodbye with reason to each of the slots that are filled. The
+// slots must no longer be in the relayList, so nothing else changes them.
+func sayGoodbye(reason string, slots ...*Slot) {
+	for _, slot := range slots {
+		if slot == nil {
+			continue
+		}
+
+		goodbye := msgs.Goodbye{Reason: reason}
+		_ = slot.connection.SetWriteDeadline(time.Now().Add(noticeTimeout))
+
+		// Hero still owns connections that haven't sent ready, so the goodbye has to go
+		// through it. Hijacked connections are written to directly.
+		var err error
+		if slot.ready {
+			err = slot.ctx.WriteMsg("goodbye", goodbye)
+		} else {
+			err = slot.ctx.Hero().Send(slot.id, "goodbye", goodbye)
+		}
+
+		if err != nil {
+			fmt.Println("Unable to say goodbye:", err)
+		}
+	}
+}
+
+// disconnectHandler removes the slot for a connection that drops before its relay
+// has been spliced, so a later connection with the same relay key can take its place.
+func (s *Server) disconnectHandler(c hero.Context) {
+	relayKey, ok := c.Get(relayKeyContextKey).(string)
+	if !ok {
+		// Connection never said hello
+		return
+	}
+
+	s.removeSlot(relayKey, c.Conn())
+}
+
+// removeSlot empties the slot holding conn in the relay for relayKey. Relays that have
+// been spliced are left alone since connectSlots cleans those up. A peer that has
+// already sent ready can't be given back to hero, so it is closed along with the relay.
+// Once a relay has no slots filled it is removed.
+func (s *Server) removeSlot(relayKey string, conn net.Conn) {
+	s.relayList.Lock()
+	defer s.relayList.Unlock()
+	relay, ok := s.relayList.relays[relayKey]
+	if !ok || relay.spliced {
+		return
+	}
+
+	switch relay.slotFor(conn) {
+	case nil:
+		return
+	case relay.sender:
+		relay.sender = nil
+	case relay.receiver:
+		relay.receiver = nil
+	}
+
+	for _, peer := range []*Slot{relay.sender, relay.receiver} {
+		if peer != nil && peer.ready {
+			_ = peer.connection.Close()
+			delete(s.relayList.relays, relayKey)
+			return
+		}
+	}
+
+	if relay.sender == nil && relay.receiver == nil {
+		delete(s.relayList.relays, relayKey)
+	}
+}
+
+func (s *Server) removeRelay(relay *Relay) {
+	s.relayList.Lock()
+	defer s.relayList.Unlock()
+	if r, ok := s.relayList.relays[relay.relayID]; ok && r == relay {
+		delete(s.relayList.relays, relay.relayID)
+	}
+}
@@ -2,110 +2,581 @@ package relay
 
 import (
 	"context"
-	"encoding/hex"
-	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
 	"net"
 	"testing"
 	"time"
 
 	"github.com/gtarcea/ft/hero"
-
-	"salsa.debian.org/vasudev/gospake2"
-
+	"github.com/gtarcea/ft/hero/herotest"
+	"github.com/gtarcea/ft/hero/herotest/paketest"
+	"github.com/gtarcea/ft/pkg/ft"
 	"github.com/gtarcea/ft/pkg/msgs"
-
-	"github.com/gtarcea/ft/internal/network"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestServerStartStop(t *testing.T) {
-	s := NewServer(":10001", "")
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		if err := s.Start(ctx); err != nil {
-			t.Fatalf("Failed to start server: %s", err)
-		}
-	}()
-	time.Sleep(1 * time.Second)
-	cancel()
-	time.Sleep(3 * time.Second)
+	s := herotest.StartServer(NewServer("", "").Serve)
+	client, err := s.Dial()
+	assert.Nil(t, err)
+	defer client.Close()
+
+	assert.Nil(t, s.Close())
 }
 
 func TestServerPakeMsg(t *testing.T) {
-	s := NewServer(":10001", "")
-	ctx, cancel := context.WithCancel(context.Background())
+	s := herotest.StartServer(NewServer("", "").Serve)
+	defer s.Close()
+
+	client, err := s.Dial()
+	assert.Nil(t, err)
+	defer client.Close()
+
+	assert.Nil(t, paketest.Pake(client, Password, AppId))
+
+	hello := msgs.Hello{RelayKey: "my-relay-key", ConnectionType: Sender}
+	assert.Nil(t, client.Send("hello", hello))
+}
+
+func TestServerPicksOfferedCipherSuite(t *testing.T) {
+	s := herotest.StartServer(NewServer("", "").Serve)
+	defer s.Close()
+
+	client, err := s.Dial()
+	assert.Nil(t, err)
+	defer client.Close()
+
+	client.CipherSuites = []hero.CipherSuite{hero.ChaCha20Poly1305, hero.AES256GCM}
+	assert.Nil(t, paketest.Pake(client, Password, AppId))
+	assert.Equal(t, hero.ChaCha20Poly1305.Name, client.CipherSuite())
+
+	// The error reply can only be read if both sides agree on the suite
+	assert.Nil(t, client.Send("ready", nil))
+	assert.True(t, errors.Is(client.Expect("", nil), ft.ErrInvalidNextState))
+}
+
+func TestServerSplicesSenderAndReceiver(t *testing.T) {
+	s := herotest.StartServer(NewServer("", "").Serve)
+	defer s.Close()
+
+	sender := connectAndWait(t, s, "splice-relay-key", Sender)
+	defer sender.Close()
+	receiver := connectAndSayHello(t, s, "splice-relay-key", Receiver)
+	defer receiver.Close()
+
+	// The relay tells the waiting sender first, then replies to the receiver
+	var joined msgs.PeerJoined
+	assert.Nil(t, sender.Expect("peer_joined", &joined))
+	assert.Equal(t, Receiver, joined.ConnectionType)
+	assert.Nil(t, receiver.Expect("peer_joined", &joined))
+	assert.Equal(t, Sender, joined.ConnectionType)
+
+	// Once both are ready the relay says go, and everything after that is piped
+	assert.Nil(t, sender.Send("ready", nil))
+	assert.Nil(t, receiver.Send("ready", nil))
+	assert.Nil(t, sender.Expect("go", nil))
+	assert.Nil(t, receiver.Expect("go", nil))
+
 	go func() {
-		if err := s.Start(ctx); err != nil {
-			t.Fatalf("Failed to start server: %s", err)
-		}
+		_, _ = sender.Conn.Write([]byte("ping"))
 	}()
 
-	time.Sleep(1 * time.Second)
-	conn, err := net.DialTimeout("tcp", ":10001", 2*time.Second)
-	if err != nil {
-		t.Fatalf("Couldn't connect to server")
+	buf := make([]byte, 4)
+	_ = receiver.Conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err := io.ReadFull(receiver.Conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestServerFreesSlotWhenWaitingPeerDisconnects(t *testing.T) {
+	relay := NewServer("", "")
+	disconnected := make(chan struct{}, 3)
+	s := herotest.StartServer(func(ctx context.Context, listener net.Listener) error {
+		h := relay.newHero(ctx)
+		h.OnDisconnect(func(c hero.Context) {
+			disconnected <- struct{}{}
+		})
+		return h.Serve(ctx, listener)
+	})
+	defer s.Close()
+
+	sender := connectAndWait(t, s, "dropped-relay-key", Sender)
+	assert.Nil(t, sender.Send("ready", nil))
+	assert.True(t, errors.Is(sender.Expect("", nil), ft.ErrPeerNotJoined))
+	_ = sender.Close()
+	<-disconnected
+
+	// A new sender can take the slot the old one left behind
+	sender = connectAndWait(t, s, "dropped-relay-key", Sender)
+	defer sender.Close()
+	receiver := connectAndSayHello(t, s, "dropped-relay-key", Receiver)
+	defer receiver.Close()
+	assert.Nil(t, sender.Expect("peer_joined", nil))
+	assert.Nil(t, receiver.Expect("peer_joined", nil))
+}
+
+func TestServerRejectsUnknownConnectionType(t *testing.T) {
+	relay := NewServer("", "")
+	s := herotest.StartServer(relay.Serve)
+	defer s.Close()
+
+	client := connectAndSayHello(t, s, "spectator-relay-key", "spectator")
+	defer client.Close()
+	assert.True(t, errors.Is(client.Expect("", nil), ft.ErrInvalidConnectionType))
+	assert.Len(t, relay.Relays(), 0)
+}
+
+func TestServerReapsRelayWhenPeerNeverJoins(t *testing.T) {
+	relay := NewServer("", "")
+	relay.WaitTimeout = 50 * time.Millisecond
+	relay.ReapInterval = 10 * time.Millisecond
+	s := herotest.StartServer(relay.Serve)
+	defer s.Close()
+
+	sender := connectAndWait(t, s, "lonely-relay-key", Sender)
+	defer sender.Close()
+
+	var goodbye msgs.Goodbye
+	assert.Nil(t, sender.Expect("goodbye", &goodbye))
+	assert.Equal(t, GoodbyePeerNeverJoined, goodbye.Reason)
+
+	_, err := sender.Read()
+	assert.NotNil(t, err)
+
+	relay.relayList.Lock()
+	assert.Len(t, relay.relayList.relays, 0)
+	relay.relayList.Unlock()
+	assert.Equal(t, int64(1), relay.Stats().RelaysReaped)
+	assert.Equal(t, int64(0), relay.Stats().RelaysReapedSpliced)
+}
+
+func TestServerReapsIdleSplicedRelay(t *testing.T) {
+	relay := NewServer("", "")
+	relay.IdleTimeout = 50 * time.Millisecond
+	relay.ReapInterval = 10 * time.Millisecond
+	s := herotest.StartServer(relay.Serve)
+	defer s.Close()
+
+	sender := connectAndWait(t, s, "idle-relay-key", Sender)
+	defer sender.Close()
+	receiver := connectAndSayHello(t, s, "idle-relay-key", Receiver)
+	defer receiver.Close()
+	assert.Nil(t, sender.Expect("peer_joined", nil))
+	assert.Nil(t, receiver.Expect("peer_joined", nil))
+	assert.Nil(t, sender.Send("ready", nil))
+	assert.Nil(t, receiver.Send("ready", nil))
+	assert.Nil(t, sender.Expect("go", nil))
+	assert.Nil(t, receiver.Expect("go", nil))
+
+	// The peers only expect each other's bytes now, so the relay hangs up without a
+	// goodbye
+	_, err := sender.Read()
+	assert.Equal(t, io.EOF, err)
+	_, err = receiver.Read()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, int64(1), relay.Stats().RelaysReapedSpliced)
+}
+
+func TestServerUsesConfiguredPasswordAndAppID(t *testing.T) {
+	relay := NewServer("", "configured-password")
+	relay.AppID = "configured-app-id"
+	s := herotest.StartServer(relay.Serve)
+	defer s.Close()
+
+	client, err := s.Dial()
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Nil(t, paketest.Pake(client, "configured-password", "configured-app-id"))
+	var waiting msgs.Waiting
+	assert.Nil(t, client.Call("hello", msgs.Hello{RelayKey: "configured-key", ConnectionType: Sender}, &waiting))
+	assert.Equal(t, Receiver, waiting.WaitingFor)
+
+	// With the default password the keys don't match, so the relay can't read the hello
+	// and drops the connection.
+	client, err = s.Dial()
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Nil(t, paketest.Pake(client, Password, AppId))
+	assert.Nil(t, client.Send("hello", msgs.Hello{RelayKey: "configured-key", ConnectionType: Receiver}))
+	_, err = client.Read()
+	assert.NotNil(t, err)
+}
+
+func TestServerChecksSlotSecrets(t *testing.T) {
+	relay := NewServer("", "")
+	relay.RequireSlotSecret = true
+	s := herotest.StartServer(relay.Serve)
+	defer s.Close()
+
+	sayHello := func(hello msgs.Hello) *herotest.Client {
+		client, err := s.Dial()
+		assert.Nil(t, err)
+		assert.Nil(t, paketest.Pake(client, Password, AppId))
+		assert.Nil(t, client.Send("hello", hello))
+		return client
 	}
 
-	pw := gospake2.NewPassword(Password)
-	spake := gospake2.SPAKE2Symmetric(pw, gospake2.NewIdentityS(AppId))
-	pakeMsgBody := spake.Start()
-	pake1 := msgs.Pake{Body: pakeMsgBody}
-	body, err := json.Marshal(pake1)
-	if err != nil {
-		t.Fatalf("Couldn't marshal pake1 msg")
+	noProof := sayHello(msgs.Hello{RelayKey: "secret-key", ConnectionType: Sender})
+	defer noProof.Close()
+	assert.True(t, errors.Is(noProof.Expect("", nil), ft.ErrSlotSecretRequired))
+
+	sender := sayHello(msgs.Hello{RelayKey: "secret-key", ConnectionType: Sender,
+		SlotProof: ft.SlotProof("secret-key", "shared secret")})
+	defer sender.Close()
+	assert.Nil(t, sender.Expect("waiting", nil))
+
+	guesser := sayHello(msgs.Hello{RelayKey: "secret-key", ConnectionType: Receiver,
+		SlotProof: ft.SlotProof("secret-key", "guessed secret")})
+	defer guesser.Close()
+	assert.True(t, errors.Is(guesser.Expect("", nil), ft.ErrSlotSecretMismatch))
+
+	receiver := sayHello(msgs.Hello{RelayKey: "secret-key", ConnectionType: Receiver,
+		SlotProof: ft.SlotProof("secret-key", "shared secret")})
+	defer receiver.Close()
+	assert.Nil(t, sender.Expect("peer_joined", nil))
+	assert.Nil(t, receiver.Expect("peer_joined", nil))
+}
+
+func TestServerRefusesPairingWhenOnlyOnePartyHasASlotSecret(t *testing.T) {
+	relay := NewServer("", "")
+	s := herotest.StartServer(relay.Serve)
+	defer s.Close()
+
+	sayHello := func(hello msgs.Hello) *herotest.Client {
+		client, err := s.Dial()
+		assert.Nil(t, err)
+		assert.Nil(t, paketest.Pake(client, Password, AppId))
+		assert.Nil(t, client.Send("hello", hello))
+		return client
 	}
-	msg := hero.Message{Action: "pake", Body: body}
-	b, err := json.Marshal(msg)
-	if err != nil {
-		t.Fatalf("Couldn't marshal message")
+
+	// The receiver has a secret the waiting sender doesn't
+	sender := connectAndWait(t, s, "half-secret-key", Sender)
+	defer sender.Close()
+	receiver := sayHello(msgs.Hello{RelayKey: "half-secret-key", ConnectionType: Receiver,
+		SlotProof: ft.SlotProof("half-secret-key", "only the receiver knows")})
+	defer receiver.Close()
+	assert.True(t, errors.Is(receiver.Expect("", nil), ft.ErrSlotSecretMismatch))
+
+	// The waiting sender has a secret the receiver doesn't
+	sender = sayHello(msgs.Hello{RelayKey: "other-half-secret-key", ConnectionType: Sender,
+		SlotProof: ft.SlotProof("other-half-secret-key", "only the sender knows")})
+	defer sender.Close()
+	assert.Nil(t, sender.Expect("waiting", nil))
+	receiver = sayHello(msgs.Hello{RelayKey: "other-half-secret-key", ConnectionType: Receiver})
+	defer receiver.Close()
+	assert.True(t, errors.Is(receiver.Expect("", nil), ft.ErrSlotSecretMismatch))
+}
+
+func TestServerDropsOversizedFramesBeforeAuthenticating(t *testing.T) {
+	s := herotest.StartServer(NewServer("", "").Serve)
+	defer s.Close()
+
+	client, err := s.Dial()
+	assert.Nil(t, err)
+	defer client.Close()
+
+	// A header claiming a 1 GiB frame, with nothing behind it
+	_, err = client.Conn.Write([]byte{0, 0, 0, 0x40})
+	assert.Nil(t, err)
+
+	// The relay hangs up rather than waiting for the rest of the frame
+	client.Timeout = time.Second
+	_, err = client.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServerSwapsExternalIPs(t *testing.T) {
+	s := herotest.StartServer(NewServer("", "").Serve)
+	defer s.Close()
+
+	sender := connectAndWait(t, s, "ips-relay-key", Sender)
+	defer sender.Close()
+	receiver := connectAndSayHello(t, s, "ips-relay-key", Receiver)
+	defer receiver.Close()
+	assert.Nil(t, sender.Expect("peer_joined", nil))
+	assert.Nil(t, receiver.Expect("peer_joined", nil))
+
+	// The sender goes first, so there is nothing from the receiver yet
+	var reply msgs.ExternalIPsReply
+	assert.Nil(t, sender.Call("external_ips", msgs.ExternalIPs{LocalAddresses: []string{"192.168.1.10:9000"}}, &reply))
+	assert.Equal(t, "pipe", reply.ObservedAddress)
+	assert.Nil(t, reply.Peer)
+
+	// The receiver gets the sender's addresses in its reply, and the sender is sent the
+	// receiver's before that
+	assert.Nil(t, receiver.Send("external_ips", msgs.ExternalIPs{LocalAddresses: []string{"10.0.0.5:9000"}}))
+	var peer msgs.ExternalIPs
+	assert.Nil(t, sender.Expect("peer_external_ips", &peer))
+	assert.Equal(t, []string{"10.0.0.5:9000"}, peer.LocalAddresses)
+	assert.Equal(t, "pipe", peer.ObservedAddress)
+
+	assert.Nil(t, receiver.Expect("external_ips", &reply))
+	assert.Equal(t, "pipe", reply.ObservedAddress)
+	if assert.NotNil(t, reply.Peer) {
+		assert.Equal(t, []string{"192.168.1.10:9000"}, reply.Peer.LocalAddresses)
 	}
 
-	if _, err := network.Write(conn, b); err != nil {
-		t.Fatalf("Couldn't write to server")
+	// external_ips is followed by ready
+	assert.Nil(t, sender.Send("ready", nil))
+	assert.Nil(t, receiver.Send("ready", nil))
+	assert.Nil(t, sender.Expect("go", nil))
+	assert.Nil(t, receiver.Expect("go", nil))
+}
+
+func TestServerRelaysBetweenClients(t *testing.T) {
+	s := herotest.StartServer(NewServer("", "").Serve)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	connect := func(connectionType string) *ft.Client {
+		client := connectClient(t, s, ft.ClientOpts{SlotSecret: "shared secret"})
+		assert.Nil(t, client.Hello("clients-relay-key", connectionType))
+		return client
 	}
 
-	buf, _, err := network.Read(conn)
-	if err != nil {
-		t.Fatalf("Unable to read response")
+	sender := connect(Sender)
+	receiver := connect(Receiver)
+
+	peer, err := sender.WaitForPeer(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, Receiver, peer)
+	peer, err = receiver.WaitForPeer(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, Sender, peer)
+
+	// go only comes once both are ready, so the receiver has to get ready alongside
+	receiverConn := make(chan net.Conn, 1)
+	go func() {
+		conn, err := receiver.Ready(ctx)
+		assert.Nil(t, err)
+		receiverConn <- conn
+	}()
+
+	senderConn, err := sender.Ready(ctx)
+	if !assert.Nil(t, err) {
+		return
 	}
+	defer senderConn.Close()
 
-	var msg2 hero.Message
-	if err := json.Unmarshal(buf, &msg2); err != nil {
-		t.Fatalf("Unable to process message")
+	conn := <-receiverConn
+	if !assert.NotNil(t, conn) {
+		return
 	}
+	defer conn.Close()
+
+	// Everything after go is the peers' own bytes, passed straight through
+	_, err = senderConn.Write([]byte("raw bytes"))
+	assert.Nil(t, err)
+	buf := make([]byte, len("raw bytes"))
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "raw bytes", string(buf))
+}
+
+func TestServerSwapsExternalIPsBetweenClients(t *testing.T) {
+	// Over loopback the relay sees both clients at 127.0.0.1, as if they shared a NAT
+	address, stop := serveOnTCP(t, NewServer("", ""))
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	connect := func(connectionType string) *ft.Client {
+		client := ft.NewClient(&ft.ClientOpts{RelayAddress: address})
+		assert.Nil(t, client.ConnectToRelay())
+		assert.Nil(t, client.Hello("external-ips-clients-key", connectionType))
+		return client
+	}
+
+	sender := connect(Sender)
+	receiver := connect(Receiver)
+	_, err := sender.WaitForPeer(ctx)
+	assert.Nil(t, err)
+	_, err = receiver.WaitForPeer(ctx)
+	assert.Nil(t, err)
+
+	// Whichever sends second gets the peer's addresses in its reply, the other has
+	// them pushed
+	receiverPeer := make(chan ft.PeerAddresses, 1)
+	go func() {
+		peer, err := receiver.ExternalIPs(ctx, 5001)
+		assert.Nil(t, err)
+		receiverPeer <- peer
+	}()
+
+	senderPeer, err := sender.ExternalIPs(ctx, 5000)
+	assert.Nil(t, err)
+	expected, err := ft.LocalAddresses(5001)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, senderPeer.LocalAddresses)
+	assert.True(t, senderPeer.SameNAT)
+
+	peer := <-receiverPeer
+	expected, err = ft.LocalAddresses(5000)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, peer.LocalAddresses)
+	assert.True(t, peer.SameNAT)
+	assert.NotEqual(t, peer.ObservedAddress, senderPeer.ObservedAddress)
+}
+
+func TestServerErrorsReachClient(t *testing.T) {
+	relay := NewServer("", "")
+	relay.RequireSlotSecret = true
+	s := herotest.StartServer(relay.Serve)
+	defer s.Close()
+
+	client := connectClient(t, s, ft.ClientOpts{})
+	assert.Nil(t, client.Hello("no-secret-key", Sender))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.WaitForPeer(ctx)
+	assert.True(t, errors.Is(err, ft.ErrSlotSecretRequired))
+}
+
+func TestServerDropsSlotWhosePeerStopsAnswering(t *testing.T) {
+	relay := NewServer("", "")
+	relay.HeartbeatInterval = 20 * time.Millisecond
+	relay.HeartbeatTimeout = 200 * time.Millisecond
+
+	address, stop := serveOnTCP(t, relay)
+	defer stop()
+
+	conn, err := net.Dial("tcp", address)
+	assert.Nil(t, err)
+	defer conn.Close()
+	client := herotest.NewClient(conn)
+	assert.Nil(t, paketest.Pake(client, Password, AppId))
+	assert.Nil(t, client.Send("hello", msgs.Hello{RelayKey: "silent-relay-key", ConnectionType: Sender}))
 
-	if msg2.Action != "pake" {
-		t.Fatalf("Msg wasn't pake, got %s instead", msg2.Action)
+	// The client never reads or answers a ping again, as if its machine had gone away
+	waitForRelays(t, relay, 1)
+	waitForRelays(t, relay, 0)
+}
+
+func TestServerKeepsSlotOfClientSendingHeartbeats(t *testing.T) {
+	relay := NewServer("", "")
+	relay.HeartbeatInterval = 10 * time.Millisecond
+	relay.HeartbeatTimeout = 100 * time.Millisecond
+	address, stop := serveOnTCP(t, relay)
+	defer stop()
+
+	opts := ft.ClientOpts{
+		RelayAddress:      address,
+		HeartbeatInterval: 10 * time.Millisecond,
+		HeartbeatTimeout:  100 * time.Millisecond,
 	}
+	sender := ft.NewClient(&opts)
+	assert.Nil(t, sender.ConnectToRelay())
+	assert.Nil(t, sender.Hello("heartbeat-relay-key", Sender))
+
+	// Waiting for several heartbeat timeouts doesn't lose the slot
+	wait, cancelWait := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancelWait()
+	_, err := sender.WaitForPeer(wait)
+	assert.Equal(t, context.DeadlineExceeded, err)
 
-	var pake2 msgs.Pake
-	if err := json.Unmarshal(msg2.Body, &pake2); err != nil {
-		t.Fatalf("Unable to unmarshal body %s", err)
+	receiver := ft.NewClient(&opts)
+	assert.Nil(t, receiver.ConnectToRelay())
+	assert.Nil(t, receiver.Hello("heartbeat-relay-key", Receiver))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = sender.WaitForPeer(ctx)
+	assert.Nil(t, err)
+	_, err = receiver.WaitForPeer(ctx)
+	assert.Nil(t, err)
+
+	// Give heartbeats a chance to go out between ready and go, where they would end up
+	// in the peer's stream
+	receiverConn := make(chan net.Conn, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn, err := receiver.Ready(ctx)
+		assert.Nil(t, err)
+		receiverConn <- conn
+	}()
+
+	senderConn, err := sender.Ready(ctx)
+	if !assert.Nil(t, err) {
+		return
 	}
+	defer senderConn.Close()
 
-	sharedKey, err := spake.Finish(pake2.Body)
-	if err != nil {
-		t.Fatalf("Spake auth (finish) failed %s", err)
+	conn := <-receiverConn
+	if !assert.NotNil(t, conn) {
+		return
 	}
+	defer conn.Close()
 
-	fmt.Printf("Client shared key as string = %s\n", hex.EncodeToString(sharedKey))
+	_, err = senderConn.Write([]byte("only these"))
+	assert.Nil(t, err)
+	buf := make([]byte, len("only these"))
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "only these", string(buf))
+}
 
-	hello := msgs.Hello{RelayKey: "my-relay-key", ConnectionType: Sender}
-	helloBytes, err := json.Marshal(hello)
-	if err != nil {
-		t.Fatalf("Unable to marshal hello message: %s", err)
+// connectAndWait says hello as the first party for relayKey, and checks the relay
+// says it is waiting for the peer.
+func connectAndWait(t *testing.T, s *herotest.Server, relayKey, connectionType string) *herotest.Client {
+	client := connectAndSayHello(t, s, relayKey, connectionType)
+	var waiting msgs.Waiting
+	assert.Nil(t, client.Expect("waiting", &waiting))
+	assert.Equal(t, peerConnectionType(connectionType), waiting.WaitingFor)
+	return client
+}
+
+func connectAndSayHello(t *testing.T, s *herotest.Server, relayKey, connectionType string) *herotest.Client {
+	client, err := s.Dial()
+	assert.Nil(t, err)
+	assert.Nil(t, paketest.Pake(client, Password, AppId))
+
+	hello := msgs.Hello{RelayKey: relayKey, ConnectionType: connectionType}
+	assert.Nil(t, client.Send("hello", hello))
+
+	return client
+}
+
+// connectClient connects an ft.Client with opts to the relay through the in-memory
+// listener.
+func connectClient(t *testing.T, s *herotest.Server, opts ft.ClientOpts) *ft.Client {
+	opts.Dial = func(string) (net.Conn, error) {
+		return s.Listener.Dial()
 	}
-	msg3 := hero.Message{Action: "hello", Body: helloBytes}
+	client := ft.NewClient(&opts)
+	assert.Nil(t, client.ConnectToRelay())
+	return client
+}
 
-	msg3Bytes, err := json.Marshal(msg3)
+// serveOnTCP runs relay on a loopback port the OS picks, for tests with heartbeats.
+// Both ends of a connection can answer each other's pings at once, which only works
+// with the buffering a real socket has, not with net.Pipe.
+func serveOnTCP(t *testing.T, relay *Server) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Fatalf("Unable to marshal msg3Bytes: %s", err)
+		t.Fatalf("Unable to listen: %s", err)
 	}
 
-	if _, err = network.WriteEncrypted(conn, msg3Bytes, sharedKey); err != nil {
-		t.Fatalf("Failed writing encrypted message: %s", err)
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_ = relay.Serve(ctx, listener)
+	}()
 
-	time.Sleep(3 * time.Second)
-	cancel()
+	return listener.Addr().String(), cancel
+}
+
+// waitForRelays waits for relay to have count relays.
+func waitForRelays(t *testing.T, relay *Server, count int) {
+	deadline := time.Now().Add(3 * time.Second)
+	for len(relay.Relays()) != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("Relay has %d relays, expected %d", len(relay.Relays()), count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
 }
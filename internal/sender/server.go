@@ -18,6 +18,7 @@ func NewServer(address string) *Server {
 	server.states.AddState("finfo", "finfo", "file-chunk", "file-done")
 	server.states.AddState("file-chunk", "file-chunk", "file-done")
 	server.states.AddState("file-done", "finfo", "done")
+	server.states.SetStartState("start")
 
 	return server
 }
@@ -1,37 +1,95 @@
 package ft
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/gtarcea/ft/hero"
-	"github.com/gtarcea/ft/internal/network"
 	"github.com/gtarcea/ft/pkg/msgs"
-	"github.com/pkg/errors"
 	"salsa.debian.org/vasudev/gospake2"
 )
 
+// ErrRelayClosed is returned when the relay connection closes without the relay saying
+// why.
+var ErrRelayClosed = errors.New("relay closed the connection")
+
 type Client struct {
 	RelayAddress  string
 	RelayPassword string
 	AppID         string
 
+	// TLSConfig is used to connect to the relay over TLS when set.
+	TLSConfig *tls.Config
+
+	// CipherSuites are offered to the relay in order of preference. Put
+	// hero.ChaCha20Poly1305 first on hardware without AES instructions. Defaults to
+	// the hero defaults.
+	CipherSuites []hero.CipherSuite
+
+	// SlotSecret is a secret for the relay key shared with the peer. When set the
+	// relay only pairs this client with a peer that has the same secret.
+	SlotSecret string
+
+	// Dial, when set, is used to connect to the relay instead of dialing RelayAddress
+	// over TCP.
+	Dial func(address string) (net.Conn, error)
+
+	// HeartbeatInterval is how often the client pings the relay while the connection
+	// is quiet, and HeartbeatTimeout is how long it waits to hear anything from the
+	// relay before deciding the relay has gone. They default to the
+	// DefaultClientOpts.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
 	// *** Internal State ***
-	relayConn net.Conn
+	hero      *hero.Hero
+	relay     hero.Context
 	relayKey  []byte
+	connected chan struct{}
+
+	// peerJoined and goConn are sent what the relay's peer_joined and go carry.
+	peerJoined chan msgs.PeerJoined
+	goConn     chan net.Conn
+
+	// observedAddress is where the relay sees this client connecting from, and peerIPs
+	// are the peer's addresses, both recorded from the relay's external_ips and
+	// peer_external_ips. peerIPsKnown is closed once both have arrived.
+	ipsMu           sync.Mutex
+	observedAddress string
+	peerIPs         *msgs.ExternalIPs
+	peerIPsKnown    chan struct{}
+
+	// done is closed with err set once the relay connection has failed, been turned
+	// away by the relay or been told goodbye.
+	done     chan struct{}
+	err      error
+	failOnce sync.Once
 }
 
 type ClientOpts struct {
 	RelayAddress  string
 	RelayPassword string
 	AppID         string
+	TLSConfig     *tls.Config
+	CipherSuites  []hero.CipherSuite
+	SlotSecret    string
+	Dial          func(address string) (net.Conn, error)
+
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
 }
 
 var DefaultClientOpts ClientOpts = ClientOpts{
-	RelayAddress:  ":10001",
-	RelayPassword: "abc123",
-	AppID:         "relay-app-id",
+	RelayAddress:      ":10001",
+	RelayPassword:     "abc123",
+	AppID:             "relay-app-id",
+	HeartbeatInterval: 30 * time.Second,
+	HeartbeatTimeout:  2 * time.Minute,
 }
 
 func NewClient(opts *ClientOpts) *Client {
@@ -41,6 +99,12 @@ func NewClient(opts *ClientOpts) *Client {
 		c.RelayPassword = opts.RelayPassword
 		c.RelayAddress = opts.RelayAddress
 		c.AppID = opts.AppID
+		c.TLSConfig = opts.TLSConfig
+		c.CipherSuites = opts.CipherSuites
+		c.SlotSecret = opts.SlotSecret
+		c.Dial = opts.Dial
+		c.HeartbeatInterval = opts.HeartbeatInterval
+		c.HeartbeatTimeout = opts.HeartbeatTimeout
 	}
 
 	c.setDefaults()
@@ -60,65 +124,310 @@ func (c *Client) setDefaults() {
 	if c.AppID == "" {
 		c.AppID = DefaultClientOpts.AppID
 	}
+
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = DefaultClientOpts.HeartbeatInterval
+	}
+
+	if c.HeartbeatTimeout == 0 {
+		c.HeartbeatTimeout = DefaultClientOpts.HeartbeatTimeout
+	}
 }
 
+// ConnectToRelay connects to the relay server and authenticates with it. Once
+// authenticated the connection is left running in the background so the relay can
+// drive the rest of the conversation.
 func (c *Client) ConnectToRelay() error {
-	var err error
-	if c.relayConn, err = net.DialTimeout("tcp", c.RelayAddress, 3*time.Second); err != nil {
-		return err
+	h := hero.NewHero("")
+	h.Codecs = []hero.Codec{hero.CBORCodec, hero.JSONCodec}
+	h.TLSConfig = c.TLSConfig
+	h.DialFunc = c.Dial
+	h.HeartbeatInterval = c.HeartbeatInterval
+	h.IdleTimeout = c.HeartbeatTimeout
+	if len(c.CipherSuites) != 0 {
+		h.CipherSuites = c.CipherSuites
 	}
+	h.Action("pake", c.exchangePake)
+	h.Action("waiting", c.waitingHandler)
+	h.Action("peer_joined", c.peerJoinedHandler)
+	h.Action("external_ips", c.externalIPsHandler)
+	h.Action("peer_external_ips", c.peerExternalIPsHandler)
+	h.Action("go", c.goHandler)
+	h.Action("goodbye", c.goodbyeHandler)
 
-	if err := c.exchangePake(); err != nil {
-		return err
+	// The relay's errors aren't replies to a call, so they arrive at the error hooks
+	h.OnError(func(_ hero.Context, err error) {
+		c.fail(err)
+	})
+
+	c.hero = h
+	c.connected = make(chan struct{})
+	c.peerJoined = make(chan msgs.PeerJoined, 1)
+	c.goConn = make(chan net.Conn, 1)
+	c.peerIPsKnown = make(chan struct{})
+	c.done = make(chan struct{})
+	go func() {
+		err := h.Connect(context.Background(), c.RelayAddress, "pake")
+		if err == nil {
+			err = ErrRelayClosed
+		}
+		c.fail(err)
+	}()
+
+	select {
+	case <-c.connected:
+		return nil
+	case <-c.done:
+		return c.err
 	}
+}
 
-	return nil
+// fail records why the relay connection can't be used any more. Only the first
+// failure is kept.
+func (c *Client) fail(err error) {
+	c.failOnce.Do(func() {
+		c.err = err
+		close(c.done)
+	})
 }
 
-func (c *Client) exchangePake() error {
+// exchangePake is the start action for the relay connection. It authenticates with the
+// relay and turns on encryption for the rest of the connection.
+func (c *Client) exchangePake(hc hero.Context) error {
+	var err error
 	pw := gospake2.NewPassword(c.RelayPassword)
 	spake := gospake2.SPAKE2Symmetric(pw, gospake2.NewIdentityS(c.AppID))
-	pakeMsgBody := spake.Start()
-	pake1 := msgs.Pake{Body: pakeMsgBody}
-	body, err := json.Marshal(pake1)
-	if err != nil {
+	pake1 := msgs.Pake{Body: spake.Start(), CipherSuites: hc.Hero().CipherSuiteNames()}
+	if err := hc.JSON("pake", pake1); err != nil {
 		return err
 	}
-	msg := hero.Message{Action: "pake", Body: body}
-	b, err := json.Marshal(msg)
-	if err != nil {
+
+	var pake2 msgs.Pake
+	if err := hc.ReadMsg(&pake2); err != nil {
 		return err
 	}
-	if _, err := network.Write(c.relayConn, b); err != nil {
+
+	if c.relayKey, err = spake.Finish(pake2.Body); err != nil {
 		return err
 	}
 
-	buf, _, err := network.Read(c.relayConn)
-	if err != nil {
+	if pake2.CipherSuite != "" {
+		if err := hc.SetCipherSuite(pake2.CipherSuite); err != nil {
+			return err
+		}
+	}
+
+	hc.SetEncryptionKey(c.relayKey)
+	if err := hc.TurnEncryptionOn(); err != nil {
 		return err
 	}
 
-	var msg2 hero.Message
-	if err := json.Unmarshal(buf, &msg2); err != nil {
+	c.relay = hc
+	close(c.connected)
+	return nil
+}
+
+// waitingHandler is told by the relay that this client arrived first. There's nothing
+// to do but wait for the peer_joined that follows when the peer arrives.
+func (c *Client) waitingHandler(hc hero.Context) error {
+	var waiting msgs.Waiting
+	return hc.Bind(&waiting)
+}
+
+// peerJoinedHandler passes the relay's peer_joined on to WaitForPeer.
+func (c *Client) peerJoinedHandler(hc hero.Context) error {
+	var peerJoined msgs.PeerJoined
+	if err := hc.Bind(&peerJoined); err != nil {
 		return err
 	}
 
-	if msg2.Action != "pake" {
-		return errors.Errorf("Msg wasn't pake")
+	c.peerJoined <- peerJoined
+	return nil
+}
+
+// externalIPsHandler records the relay's reply to ExternalIPs. The peer's addresses are
+// only in it if the peer sent them first, otherwise they follow in peer_external_ips.
+func (c *Client) externalIPsHandler(hc hero.Context) error {
+	var reply msgs.ExternalIPsReply
+	if err := hc.Bind(&reply); err != nil {
+		return err
 	}
 
-	var pake2 msgs.Pake
-	if err := json.Unmarshal(msg2.Body, &pake2); err != nil {
+	c.recordExternalIPs(reply.ObservedAddress, reply.Peer)
+	return nil
+}
+
+// peerExternalIPsHandler records the peer's addresses when the relay passes them on
+// after this client sent its own.
+func (c *Client) peerExternalIPsHandler(hc hero.Context) error {
+	var peerIPs msgs.ExternalIPs
+	if err := hc.Bind(&peerIPs); err != nil {
 		return err
 	}
 
-	if c.relayKey, err = spake.Finish(pake2.Body); err != nil {
+	c.recordExternalIPs("", &peerIPs)
+	return nil
+}
+
+// recordExternalIPs keeps what the relay sent about this client's and the peer's
+// addresses, and lets ExternalIPs return once it has both. The relay can push the
+// peer's addresses before it replies, so they may come in either order.
+func (c *Client) recordExternalIPs(observedAddress string, peerIPs *msgs.ExternalIPs) {
+	c.ipsMu.Lock()
+	defer c.ipsMu.Unlock()
+
+	if observedAddress != "" {
+		c.observedAddress = observedAddress
+	}
+
+	if peerIPs != nil && c.peerIPs == nil {
+		c.peerIPs = peerIPs
+	}
+
+	if c.observedAddress == "" || c.peerIPs == nil {
+		return
+	}
+
+	select {
+	case <-c.peerIPsKnown:
+	default:
+		close(c.peerIPsKnown)
+	}
+}
+
+// goHandler hands the connection over when the relay says go. Everything after go
+// comes from the peer, and as Ready hijacked the connection hero stops reading it once
+// this returns.
+func (c *Client) goHandler(hc hero.Context) error {
+	conn := hc.Hijack()
+
+	// Hero sets a read deadline on every message read. Clear it so a quiet peer doesn't
+	// time out.
+	_ = conn.SetDeadline(time.Time{})
+	c.goConn <- conn
+	return nil
+}
+
+// goodbyeHandler fails the client with the reason the relay gave for closing it.
+func (c *Client) goodbyeHandler(hc hero.Context) error {
+	var goodbye msgs.Goodbye
+	if err := hc.Bind(&goodbye); err != nil {
 		return err
 	}
 
+	c.fail(fmt.Errorf("relay said goodbye: %s", goodbye.Reason))
 	return nil
 }
 
+// NewHello creates the hello for joining the relay with relayKey as connectionType,
+// including the proof of SlotSecret when there is one.
+func (c *Client) NewHello(relayKey, connectionType string) msgs.Hello {
+	hello := msgs.Hello{RelayKey: relayKey, ConnectionType: connectionType}
+	if c.SlotSecret != "" {
+		hello.SlotProof = SlotProof(relayKey, c.SlotSecret)
+	}
+
+	return hello
+}
+
+// Hello joins the relay for relayKey as connectionType. An error from the relay, such
+// as the slot already being taken, is returned by WaitForPeer.
+func (c *Client) Hello(relayKey, connectionType string) error {
+	return c.hero.Send(c.relay.ID(), "hello", c.NewHello(relayKey, connectionType))
+}
+
+// WaitForPeer waits for the relay to say the peer has joined, and returns the
+// peer's connection type.
+func (c *Client) WaitForPeer(ctx context.Context) (string, error) {
+	select {
+	case peerJoined := <-c.peerJoined:
+		return peerJoined.ConnectionType, nil
+	case <-c.done:
+		return "", c.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// PeerAddresses is where the peer can be reached, as learned through the relay.
+type PeerAddresses struct {
+	// LocalAddresses are the addresses the peer has on its own network.
+	LocalAddresses []string
+
+	// ObservedAddress is the address the relay sees the peer connecting from.
+	ObservedAddress string
+
+	// SameNAT is true when the relay saw both clients at the same public IP, see
+	// BehindSameNAT. The peer's LocalAddresses are then worth trying directly.
+	SameNAT bool
+}
+
+// ExternalIPs sends the relay this client's LocalAddresses for port and waits for the
+// peer's addresses, which the relay swaps once both clients have sent theirs. It has
+// to be called after WaitForPeer, and before Ready.
+func (c *Client) ExternalIPs(ctx context.Context, port int) (PeerAddresses, error) {
+	addresses, err := LocalAddresses(port)
+	if err != nil {
+		return PeerAddresses{}, err
+	}
+
+	if err := c.hero.Send(c.relay.ID(), "external_ips", msgs.ExternalIPs{LocalAddresses: addresses}); err != nil {
+		return PeerAddresses{}, err
+	}
+
+	select {
+	case <-c.peerIPsKnown:
+	case <-c.done:
+		return PeerAddresses{}, c.err
+	case <-ctx.Done():
+		return PeerAddresses{}, ctx.Err()
+	}
+
+	c.ipsMu.Lock()
+	defer c.ipsMu.Unlock()
+	return PeerAddresses{
+		LocalAddresses:  c.peerIPs.LocalAddresses,
+		ObservedAddress: c.peerIPs.ObservedAddress,
+		SameNAT:         BehindSameNAT(c.observedAddress, c.peerIPs.ObservedAddress),
+	}, nil
+}
+
+// WaitForReceiver waits for the receiver to join the relay, for a client that said
+// hello as the sender.
 func (c *Client) WaitForReceiver() error {
-	return nil
+	_, err := c.WaitForPeer(context.Background())
+	return err
+}
+
+// Ready tells the relay this client is ready and waits for go, which the relay sends
+// once the peer is ready too. The relay then pipes the connection to the peer, so it
+// is returned for the caller to exchange bytes with the peer directly. It has to be
+// called after WaitForPeer.
+func (c *Client) Ready(ctx context.Context) (net.Conn, error) {
+	// Take the connection from hero before saying ready. The relay passes on anything
+	// after ready to the peer, so a heartbeat written then would reach the peer as if
+	// it were the peer's data. Hero still reads the connection until go arrives.
+	conn := c.relay.Hijack()
+	if err := c.relay.WriteMsg("ready", nil); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	select {
+	case conn := <-c.goConn:
+		return conn, nil
+	case <-c.done:
+		// The relay connection ends in hero once go has been handled, so go may have
+		// arrived first
+		select {
+		case conn := <-c.goConn:
+			return conn, nil
+		default:
+			_ = conn.Close()
+			return nil, c.err
+		}
+	case <-ctx.Done():
+		_ = conn.Close()
+		return nil, ctx.Err()
+	}
 }
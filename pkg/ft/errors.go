@@ -0,0 +1,17 @@
+package ft
+
+import "github.com/gtarcea/ft/hero"
+
+// Errors the relay sends back when a connection can't authenticate or join a relay. They come back
+// to the client as hero errors, so they can be checked with errors.Is.
+var (
+	ErrAlreadyHaveSender     = hero.NewError("already_have_sender", "already have a sender")
+	ErrAlreadyHaveReceiver   = hero.NewError("already_have_receiver", "already have a receiver")
+	ErrRelaySlotsFull        = hero.NewError("relay_slots_full", "relay slots full")
+	ErrPeerNotJoined         = hero.NewError("peer_not_joined", "peer hasn't joined the relay")
+	ErrInvalidConnectionType = hero.NewError("invalid_connection_type", "connection type must be sender or receiver")
+	ErrNoCommonCipherSuite   = hero.NewError("no_common_cipher_suite", "no cipher suite in common")
+	ErrSlotSecretRequired    = hero.NewError("slot_secret_required", "relay requires a secret for the relay key")
+	ErrSlotSecretMismatch    = hero.NewError("slot_secret_mismatch", "relay key secret doesn't match the peer's")
+	ErrAddressBanned         = hero.NewError("address_banned", "address is banned from the relay")
+)
@@ -0,0 +1,52 @@
+package ft
+
+import (
+	"net"
+	"strconv"
+)
+
+// LocalAddresses returns host:port addresses for port on each of this machine's
+// interface addresses, skipping loopback and link local ones. They are what a client
+// sends in external_ips so a peer on the same network can try connecting directly.
+func LocalAddresses(port int) ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ip := ipNet.IP
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+			continue
+		}
+
+		addresses = append(addresses, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+
+	return addresses, nil
+}
+
+// BehindSameNAT returns true when the relay saw both clients connect from the same
+// public IP, in which case they are likely on the same network and should try each
+// other's local addresses before relaying. The addresses are the ObservedAddress of
+// each client.
+func BehindSameNAT(ownObservedAddress, peerObservedAddress string) bool {
+	ownHost, _, err := net.SplitHostPort(ownObservedAddress)
+	if err != nil {
+		return false
+	}
+
+	peerHost, _, err := net.SplitHostPort(peerObservedAddress)
+	if err != nil {
+		return false
+	}
+
+	ownIP, peerIP := net.ParseIP(ownHost), net.ParseIP(peerHost)
+	return ownIP != nil && ownIP.Equal(peerIP)
+}
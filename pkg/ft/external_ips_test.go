@@ -0,0 +1,22 @@
+package ft
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBehindSameNAT(t *testing.T) {
+	assert.True(t, BehindSameNAT("203.0.113.7:51000", "203.0.113.7:42000"))
+	assert.False(t, BehindSameNAT("203.0.113.7:51000", "198.51.100.2:42000"))
+	assert.False(t, BehindSameNAT("pipe", "pipe"))
+}
+
+func TestLocalAddressesUsePort(t *testing.T) {
+	addresses, err := LocalAddresses(9000)
+	assert.Nil(t, err)
+	for _, address := range addresses {
+		assert.Regexp(t, `:9000$`, address)
+		assert.NotContains(t, address, "127.0.0.1")
+	}
+}
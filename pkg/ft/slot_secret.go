@@ -0,0 +1,16 @@
+package ft
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// SlotProof is what a client sends in its hello to show it knows the secret for
+// relayKey. The relay pairs two clients only when their proofs match, and never sees
+// the secret itself. The proof is tied to relayKey so it can't be reused for another
+// relay key.
+func SlotProof(relayKey, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte("ft relay slot " + relayKey))
+	return mac.Sum(nil)
+}
@@ -1,33 +1,68 @@
 package ft
 
-import "fmt"
+import (
+	"sync"
 
+	"github.com/gtarcea/ft/hero"
+)
+
+// State is a state machine made up of a graph of states and their valid transitions,
+// plus the state the machine is currently in. A State can be used as a template by
+// setting up its graph once and then calling NewInstance to get independent state
+// machines that share that graph.
 type State struct {
-	states       map[string]map[string]string
+	graph        *stateGraph
+	startState   string
 	CurrentState string
 }
 
-var ErrUnknownState = fmt.Errorf("unknown state")
-var ErrInvalidNextState = fmt.Errorf("invalid next state")
+// stateGraph holds the states and transitions. It is shared between a template and
+// all the instances created from it, so access to it is locked.
+type stateGraph struct {
+	states map[string]map[string]string
+	sync.RWMutex
+}
+
+var ErrUnknownState = hero.NewError("unknown_state", "unknown state")
+var ErrInvalidNextState = hero.NewError("invalid_next_state", "invalid next state")
+
+// stateContextKey is the key the per connection State is stored under in the hero.Context.
+const stateContextKey = "ft.state"
 
 func NewState() *State {
 	return &State{
-		states: make(map[string]map[string]string),
+		graph: &stateGraph{states: make(map[string]map[string]string)},
 	}
 }
 
+// SetStartState sets the state new instances start in and moves the CurrentState to it.
 func (s *State) SetStartState(state string) {
+	s.startState = state
 	s.CurrentState = state
 }
 
+// NewInstance returns a new State that shares the graph of s but has its own
+// CurrentState, set to the start state. Instances are independent of each other
+// so each one can track a different connection.
+func (s *State) NewInstance() *State {
+	return &State{
+		graph:        s.graph,
+		startState:   s.startState,
+		CurrentState: s.startState,
+	}
+}
+
 // AddState will create a new state if it doesn't exist and will add the
 // transitions as valid transitions for that state. If the state already
 // exists it will add the transitions to the state.
 func (s *State) AddState(state string, transitions ...string) {
-	states, ok := s.states[state]
+	s.graph.Lock()
+	defer s.graph.Unlock()
+
+	states, ok := s.graph.states[state]
 	if !ok {
 		states = make(map[string]string)
-		s.states[state] = states
+		s.graph.states[state] = states
 	}
 	for _, transition := range transitions {
 		states[transition] = transition
@@ -53,7 +88,10 @@ func (s *State) IsValidNextState(nextState string) bool {
 // will return false and either ErrUnknownState if CurrentState is not a known state, or
 // false and ErrInvalidNextState if transitionState is not a valid next state from CurrentState.
 func (s *State) IsValidNextStateWithError(nextState string) (bool, error) {
-	states, ok := s.states[s.CurrentState]
+	s.graph.RLock()
+	defer s.graph.RUnlock()
+
+	states, ok := s.graph.states[s.CurrentState]
 	if !ok {
 		return false, ErrUnknownState
 	}
@@ -73,3 +111,33 @@ func (s *State) ValidateAndAdvanceToNextState(nextState string) error {
 	s.CurrentState = nextState
 	return nil
 }
+
+// StateMiddleware returns hero middleware that gives each connection its own
+// instance of template, stored in the connection's context, and validates that
+// each action is a valid transition from the connection's current state.
+func StateMiddleware(template *State) hero.HandlerFunc {
+	return func(c hero.Context) error {
+		state := StateFromContext(c)
+		if state == nil {
+			state = template.NewInstance()
+			c.Set(stateContextKey, state)
+		}
+
+		from := state.CurrentState
+		if err := state.ValidateAndAdvanceToNextState(c.Action()); err != nil {
+			if herr, ok := err.(*hero.Error); ok {
+				return herr.WithDetail("state", from).WithDetail("action", c.Action())
+			}
+			return err
+		}
+
+		return nil
+	}
+}
+
+// StateFromContext returns the State for the connection, or nil if StateMiddleware
+// hasn't created one yet.
+func StateFromContext(c hero.Context) *State {
+	state, _ := c.Get(stateContextKey).(*State)
+	return state
+}
@@ -0,0 +1,40 @@
+package ft
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gtarcea/ft/hero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateInstancesAreIndependent(t *testing.T) {
+	template := NewState()
+	template.AddState("start", "pake")
+	template.AddState("pake", "hello")
+	template.SetStartState("start")
+
+	first := template.NewInstance()
+	second := template.NewInstance()
+
+	assert.Nil(t, first.ValidateAndAdvanceToNextState("pake"))
+	assert.Nil(t, first.ValidateAndAdvanceToNextState("hello"))
+	assert.Equal(t, "hello", first.CurrentState)
+
+	// second hasn't moved, so it can still start from the beginning
+	assert.Equal(t, "start", second.CurrentState)
+	assert.Nil(t, second.ValidateAndAdvanceToNextState("pake"))
+
+	// The template itself is unaffected by its instances
+	assert.Equal(t, "start", template.CurrentState)
+	assert.Equal(t, ErrInvalidNextState, template.ValidateAndAdvanceToNextState("hello"))
+}
+
+func TestInvalidNextStateKeepsItsCode(t *testing.T) {
+	// The relay adds details to ErrInvalidNextState before sending it, and the client
+	// gets a new hero.Error back, so matching has to go by code.
+	err := ErrInvalidNextState.WithDetail("state", "start")
+	assert.True(t, errors.Is(err, ErrInvalidNextState))
+	assert.False(t, errors.Is(err, ErrUnknownState))
+	assert.True(t, errors.Is(&hero.Error{Code: ErrInvalidNextState.Code}, ErrInvalidNextState))
+}
@@ -6,16 +6,56 @@ const RoleSender = "sender"
 type Hello struct {
 	RelayKey       string `json:"relay_key"`
 	ConnectionType string `json:"connection_type"`
+
+	// SlotProof shows the relay that the sender and receiver share a secret for the
+	// relay key, without giving the secret to the relay.
+	SlotProof []byte `json:"slot_proof,omitempty"`
 }
 
 type Welcome struct {
 	PakeMsg []byte `json:"pake_msg"`
 }
 
+// Waiting is the relay's reply to the first hello for a relay key. WaitingFor is
+// the connection type of the peer that hasn't arrived yet. A PeerJoined follows when
+// it does.
+type Waiting struct {
+	WaitingFor string `json:"waiting_for"`
+}
+
+// PeerJoined tells a client its peer is in the relay, and that it should send ready.
+// Once both have sent ready the relay sends go, after which everything on the
+// connection comes from the peer.
+type PeerJoined struct {
+	ConnectionType string `json:"connection_type"`
+}
+
+// ExternalIPs describes where a client can be reached. A client sends its
+// LocalAddresses to the relay, and the relay fills in ObservedAddress with the address
+// the client's connection comes from when it passes them on to the peer.
+type ExternalIPs struct {
+	LocalAddresses  []string `json:"local_addresses,omitempty"`
+	ObservedAddress string   `json:"observed_address,omitempty"`
+}
+
+// ExternalIPsReply is the relay's answer to a client's ExternalIPs. Peer is only set
+// if the peer has already sent its addresses, otherwise they are sent as a
+// peer_external_ips message when it does.
+type ExternalIPsReply struct {
+	ObservedAddress string       `json:"observed_address"`
+	Peer            *ExternalIPs `json:"peer,omitempty"`
+}
+
 type Goodbye struct {
 	Reason string `json:"reason"`
 }
 
 type Pake struct {
 	Body []byte `json:"body"`
+
+	// CipherSuites is sent by the client with the names of the cipher suites it can
+	// use, in order of preference. The server answers with the one it picked in
+	// CipherSuite. When no suites are offered AES-256-GCM is used.
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+	CipherSuite  string   `json:"cipher_suite,omitempty"`
 }